@@ -6,7 +6,7 @@ import (
 	"fmt"
 )
 
-// +tsgen typevar
+// +tsgen typevar numeric
 type NumT float64
 
 func avg(a interface{}) float64 {
@@ -0,0 +1,593 @@
+package gen
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go/token"
+	"go/types"
+	"golang.org/x/tools/go/callgraph"
+	"golang.org/x/tools/go/callgraph/rta"
+	"golang.org/x/tools/go/callgraph/vta"
+	"golang.org/x/tools/go/pointer"
+	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/types/typeutil"
+)
+
+// Analysis is the algorithm to find the call sites of the functions
+// and the types of the arguments given to them.
+// Except AnalysisPointer, the types are found by following the values
+// back to where they are converted to interfaces, along the call graph built by the algorithm.
+type Analysis int
+
+const (
+	// AnalysisPointer uses the whole-program pointer analysis.
+	// The most precise and the slowest.
+	AnalysisPointer Analysis = iota
+	// AnalysisCHA uses the call graph by Class Hierarchy Analysis,
+	// in which interface method calls may go to any types having the methods.
+	// The least precise and the fastest.
+	AnalysisCHA
+	// AnalysisRTA uses the call graph by Rapid Type Analysis,
+	// which considers only the types converted to interfaces in the code reachable from main.
+	AnalysisRTA
+	// AnalysisVTA uses the call graph by Variable Type Analysis,
+	// which refines the one by CHA with the types flowing to each variable.
+	AnalysisVTA
+)
+
+var analysisNames = map[Analysis]string{
+	AnalysisPointer: "pointer",
+	AnalysisCHA:     "cha",
+	AnalysisRTA:     "rta",
+	AnalysisVTA:     "vta",
+}
+
+// String implements flag.Value.
+func (a Analysis) String() string {
+	return analysisNames[a]
+}
+
+// Set implements flag.Value.
+func (a *Analysis) Set(s string) error {
+	for analysis, name := range analysisNames {
+		if s == name {
+			*a = analysis
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown analysis: %q", s)
+}
+
+// analysisResult is the result of the analysis on the program.
+// It is computed once on demand and shared by all the type switches in all the files.
+type analysisResult struct {
+	prog      *ssa.Program
+	callGraph *callgraph.Graph
+
+	// pointer is the result of the pointer analysis if run,
+	// with the queries for the values whose types may be asked (see addPointerQueries).
+	pointer *pointer.Result
+
+	// flow follows the values for the other analyses,
+	// or the ones not queried to the pointer analysis.
+	flow *typeFlow
+}
+
+// analyze runs the analysis by g.Analysis on the program
+// if not yet, and returns the result.
+func (g *Gen) analyze() (*analysisResult, error) {
+	if g.result != nil {
+		return g.result, nil
+	}
+
+	start := time.Now()
+
+	result := &analysisResult{prog: g.ssaProgram}
+
+	if g.Analysis == AnalysisPointer {
+		conf, err := g.pointerConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		g.addPointerQueries(conf)
+
+		result.pointer, err = pointer.Analyze(conf)
+		if err != nil {
+			return nil, err
+		}
+
+		result.callGraph = result.pointer.CallGraph
+	} else {
+		var err error
+		result.callGraph, err = g.callGraph()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g.log(nil, nil, "%s analysis done in %s", g.Analysis, time.Since(start))
+
+	g.result = result
+
+	return result, nil
+}
+
+// addPointerQueries adds to conf the queries for the values
+// whose types may be asked after the analysis, so that it runs only once:
+// the arguments of the calls, which may be to the functions with type switches,
+// and the interface values in the packages having templates, which may be the type switch subjects.
+// The arguments converted to interfaces right at the call sites are not queried,
+// as their types are obvious.
+func (g *Gen) addPointerQueries(conf *pointer.Config) {
+	templatePkgs := map[*types.Package]bool{}
+	for _, pkg := range g.program.AllPackages {
+		if g.hasTemplates(pkg) {
+			templatePkgs[pkg.Pkg] = true
+		}
+	}
+
+	query := func(v ssa.Value) {
+		if !pointer.CanPoint(v.Type()) {
+			return
+		}
+
+		switch t := v.Type().Underlying().(type) {
+		case *types.Interface:
+			conf.AddQuery(v)
+		case *types.Pointer:
+			if _, ok := t.Elem().Underlying().(*types.Interface); ok && pointer.CanPoint(t.Elem()) {
+				conf.AddIndirectQuery(v)
+			}
+		}
+	}
+
+	for fn := range allFunctions(g.ssaProgram) {
+		inTemplatePkg := fn.Pkg != nil && templatePkgs[fn.Pkg.Pkg]
+		if inTemplatePkg {
+			for _, p := range fn.Params {
+				query(p)
+			}
+			for _, fv := range fn.FreeVars {
+				query(fv)
+			}
+		}
+
+		for _, b := range fn.Blocks {
+			for _, instr := range b.Instrs {
+				if site, ok := instr.(ssa.CallInstruction); ok {
+					for _, a := range site.Common().Args {
+						if _, ok := a.(*ssa.MakeInterface); !ok {
+							query(a)
+						}
+					}
+				}
+
+				if v, ok := instr.(ssa.Value); ok && inTemplatePkg {
+					query(v)
+				}
+			}
+		}
+	}
+}
+
+// valueTypes returns the dynamic types value may hold,
+// or the value value points to if indirect is true,
+// in the sorted order.
+func (r *analysisResult) valueTypes(value ssa.Value, indirect bool) []types.Type {
+	if r.pointer != nil {
+		queries := r.pointer.Queries
+		if indirect {
+			queries = r.pointer.IndirectQueries
+		}
+
+		if ptr, ok := queries[value]; ok {
+			return dynamicTypes(ptr)
+		}
+	}
+
+	if r.flow == nil {
+		r.flow = newTypeFlow(r.prog, r.callGraph)
+	}
+
+	return r.flow.valueTypes(value, indirect)
+}
+
+// callGraph builds the call graph of the program by g.Analysis,
+// other than AnalysisPointer.
+func (g *Gen) callGraph() (*callgraph.Graph, error) {
+	switch g.Analysis {
+	case AnalysisCHA:
+		return chaCallGraph(g.ssaProgram), nil
+
+	case AnalysisRTA:
+		mains, err := g.ssaMainPackages()
+		if err != nil {
+			return nil, err
+		}
+
+		roots := []*ssa.Function{}
+		for _, ssaMain := range mains {
+			for _, name := range []string{"init", "main"} {
+				if fn := ssaMain.Func(name); fn != nil {
+					roots = append(roots, fn)
+				}
+			}
+		}
+
+		return rta.Analyze(roots, true).CallGraph, nil
+
+	case AnalysisVTA:
+		return vta.CallGraph(allFunctions(g.ssaProgram), chaCallGraph(g.ssaProgram)), nil
+	}
+
+	return nil, fmt.Errorf("BUG: unknown analysis: %d", g.Analysis)
+}
+
+// allFunctions returns the functions in prog: the package members,
+// the methods of the runtime types, and the ones referred by those,
+// e.g. function literals and wrappers.
+// It is ssautil.AllFunctions, which cannot be used with the pointer analysis
+// as the versions of x/tools having both do not build with the recent Go.
+func allFunctions(prog *ssa.Program) map[*ssa.Function]bool {
+	fns := map[*ssa.Function]bool{}
+
+	var visit func(fn *ssa.Function)
+	visit = func(fn *ssa.Function) {
+		if fn == nil || fns[fn] {
+			return
+		}
+		fns[fn] = true
+
+		var buf [10]*ssa.Value
+		for _, b := range fn.Blocks {
+			for _, instr := range b.Instrs {
+				for _, op := range instr.Operands(buf[:0]) {
+					if fn, ok := (*op).(*ssa.Function); ok {
+						visit(fn)
+					}
+				}
+			}
+		}
+	}
+
+	for _, pkg := range prog.AllPackages() {
+		for _, mem := range pkg.Members {
+			if fn, ok := mem.(*ssa.Function); ok {
+				visit(fn)
+			}
+		}
+	}
+
+	for _, t := range prog.RuntimeTypes() {
+		mset := prog.MethodSets.MethodSet(t)
+		for i := 0; i < mset.Len(); i++ {
+			visit(prog.MethodValue(mset.At(i)))
+		}
+	}
+
+	return fns
+}
+
+// chaCallGraph builds the call graph of prog by Class Hierarchy Analysis:
+// a call through an interface may go to the method of any type implementing it,
+// and a call of a function value to any function of the same signature.
+// It is cha.CallGraph, which cannot be used for the same reason as allFunctions.
+func chaCallGraph(prog *ssa.Program) *callgraph.Graph {
+	cg := callgraph.New(nil)
+
+	fns := allFunctions(prog)
+
+	var funcsBySig typeutil.Map // of []*ssa.Function
+	methodsByName := map[string][]*ssa.Function{}
+	for fn := range fns {
+		if fn.Signature.Recv() != nil {
+			methodsByName[fn.Name()] = append(methodsByName[fn.Name()], fn)
+			continue
+		}
+
+		// Package initializers cannot be called by values
+		if fn.Name() == "init" && fn.Synthetic == "package initializer" {
+			continue
+		}
+
+		funcs, _ := funcsBySig.At(fn.Signature).([]*ssa.Function)
+		funcsBySig.Set(fn.Signature, append(funcs, fn))
+	}
+
+	callees := func(common *ssa.CallCommon) []*ssa.Function {
+		if callee := common.StaticCallee(); callee != nil {
+			return []*ssa.Function{callee}
+		}
+
+		if common.IsInvoke() {
+			iface := common.Value.Type().Underlying().(*types.Interface)
+
+			methods := []*ssa.Function{}
+			for _, fn := range methodsByName[common.Method.Name()] {
+				if types.Implements(fn.Signature.Recv().Type(), iface) {
+					methods = append(methods, fn)
+				}
+			}
+			return methods
+		}
+
+		if _, ok := common.Value.(*ssa.Builtin); ok {
+			return nil
+		}
+
+		funcs, _ := funcsBySig.At(common.Signature()).([]*ssa.Function)
+		return funcs
+	}
+
+	for fn := range fns {
+		node := cg.CreateNode(fn)
+		for _, b := range fn.Blocks {
+			for _, instr := range b.Instrs {
+				if site, ok := instr.(ssa.CallInstruction); ok {
+					for _, callee := range callees(site.Common()) {
+						callgraph.AddEdge(node, site, cg.CreateNode(callee))
+					}
+				}
+			}
+		}
+	}
+
+	return cg
+}
+
+// typeFlow finds the dynamic types of interface values without the pointer analysis.
+// It follows the values backwards through conversions, phi nodes,
+// parameters and results along the call graph, variables captured by closures, and memory.
+// The values stored to memory are tracked by the variables, struct fields
+// or element types, not by the objects they are stored to.
+type typeFlow struct {
+	cg *callgraph.Graph
+
+	// stores maps locations (see locationKeys) to the values stored to them.
+	stores map[interface{}][]ssa.Value
+
+	// bindings maps the free variables of closures to the values captured for them.
+	bindings map[*ssa.FreeVar][]ssa.Value
+}
+
+// elemKey is a location of the elements of slices, arrays, maps or channels of the type.
+type elemKey string
+
+// newTypeFlow returns a typeFlow on the call graph cg of prog.
+func newTypeFlow(prog *ssa.Program, cg *callgraph.Graph) *typeFlow {
+	f := &typeFlow{
+		cg:       cg,
+		stores:   map[interface{}][]ssa.Value{},
+		bindings: map[*ssa.FreeVar][]ssa.Value{},
+	}
+
+	fns := allFunctions(prog)
+
+	for fn := range fns {
+		for _, b := range fn.Blocks {
+			for _, instr := range b.Instrs {
+				if mc, ok := instr.(*ssa.MakeClosure); ok {
+					closure := mc.Fn.(*ssa.Function)
+					for i, fv := range closure.FreeVars {
+						f.bindings[fv] = append(f.bindings[fv], mc.Bindings[i])
+					}
+				}
+			}
+		}
+	}
+
+	for fn := range fns {
+		for _, b := range fn.Blocks {
+			for _, instr := range b.Instrs {
+				switch instr := instr.(type) {
+				case *ssa.Store:
+					for _, key := range f.locationKeys(instr.Addr) {
+						f.stores[key] = append(f.stores[key], instr.Val)
+					}
+
+				case *ssa.MapUpdate:
+					key := elemKey(instr.Map.Type().Underlying().(*types.Map).Elem().String())
+					f.stores[key] = append(f.stores[key], instr.Value)
+
+				case *ssa.Send:
+					key := elemKey(instr.Chan.Type().Underlying().(*types.Chan).Elem().String())
+					f.stores[key] = append(f.stores[key], instr.X)
+				}
+			}
+		}
+	}
+
+	return f
+}
+
+// locationKeys returns the locations the address addr may point to.
+// The variables captured by closures are accessed through the free variables
+// bound to their addresses.
+func (f *typeFlow) locationKeys(addr ssa.Value) []interface{} {
+	switch addr := addr.(type) {
+	case *ssa.Alloc, *ssa.Global:
+		return []interface{}{addr}
+
+	case *ssa.FieldAddr:
+		st := addr.X.Type().Underlying().(*types.Pointer).Elem().Underlying().(*types.Struct)
+		return []interface{}{st.Field(addr.Field)}
+
+	case *ssa.IndexAddr:
+		return []interface{}{elemKey(addr.Type().Underlying().(*types.Pointer).Elem().String())}
+
+	case *ssa.FreeVar:
+		keys := []interface{}{}
+		for _, b := range f.bindings[addr] {
+			keys = append(keys, f.locationKeys(b)...)
+		}
+		return keys
+	}
+
+	return nil
+}
+
+// valueTypes returns the dynamic types value may hold,
+// or the value value points to if indirect is true,
+// in the sorted order.
+func (f *typeFlow) valueTypes(value ssa.Value, indirect bool) []types.Type {
+	w := &typeFlowWalk{
+		typeFlow: f,
+		seen:     map[ssa.Value]bool{},
+	}
+
+	if indirect {
+		w.loadAll(w.locationKeys(value))
+	} else {
+		w.walk(value)
+	}
+
+	sort.Sort(byTypeString(w.types))
+
+	return w.types
+}
+
+// typeFlowWalk is a state of typeFlow.valueTypes.
+type typeFlowWalk struct {
+	*typeFlow
+	seen  map[ssa.Value]bool
+	types []types.Type
+}
+
+func (w *typeFlowWalk) add(t types.Type) {
+	for _, u := range w.types {
+		if types.Identical(t, u) {
+			return
+		}
+	}
+
+	w.types = append(w.types, t)
+}
+
+func (w *typeFlowWalk) walk(v ssa.Value) {
+	if w.seen[v] {
+		return
+	}
+	w.seen[v] = true
+
+	switch v := v.(type) {
+	case *ssa.MakeInterface:
+		w.add(v.X.Type())
+
+	case *ssa.ChangeInterface:
+		w.walk(v.X)
+
+	case *ssa.TypeAssert:
+		// Asserted to an interface type
+		w.walk(v.X)
+
+	case *ssa.Phi:
+		for _, e := range v.Edges {
+			w.walk(e)
+		}
+
+	case *ssa.FreeVar:
+		for _, b := range w.bindings[v] {
+			w.walk(b)
+		}
+
+	case *ssa.Parameter:
+		fn := v.Parent()
+		node := w.cg.Nodes[fn]
+		if node == nil {
+			break
+		}
+
+		for i, p := range fn.Params {
+			if p != v {
+				continue
+			}
+
+			for _, edge := range node.In {
+				if edge.Site != nil {
+					w.walk(callArg(edge.Site, i))
+				}
+			}
+		}
+
+	case *ssa.Call:
+		w.results(v, 0)
+
+	case *ssa.Extract:
+		switch t := v.Tuple.(type) {
+		case *ssa.Call:
+			w.results(t, v.Index)
+		case *ssa.TypeAssert:
+			if v.Index == 0 {
+				w.walk(t.X)
+			}
+		case *ssa.UnOp:
+			if v.Index == 0 {
+				w.load(elemKey(t.X.Type().Underlying().(*types.Chan).Elem().String()))
+			}
+		case *ssa.Lookup:
+			if v.Index == 0 {
+				w.load(elemKey(t.X.Type().Underlying().(*types.Map).Elem().String()))
+			}
+		}
+
+	case *ssa.UnOp:
+		switch v.Op {
+		case token.MUL:
+			w.loadAll(w.locationKeys(v.X))
+		case token.ARROW:
+			w.load(elemKey(v.Type().String()))
+		}
+
+	case *ssa.Field:
+		w.load(v.X.Type().Underlying().(*types.Struct).Field(v.Field))
+
+	case *ssa.Index, *ssa.Lookup:
+		w.load(elemKey(v.Type().String()))
+	}
+}
+
+// load walks the values stored to the location key.
+func (w *typeFlowWalk) load(key interface{}) {
+	if key == nil {
+		return
+	}
+
+	for _, v := range w.stores[key] {
+		w.walk(v)
+	}
+}
+
+// loadAll walks the values stored to the locations keys.
+func (w *typeFlowWalk) loadAll(keys []interface{}) {
+	for _, key := range keys {
+		w.load(key)
+	}
+}
+
+// results walks the nth results of the functions called by call.
+func (w *typeFlowWalk) results(call *ssa.Call, nth int) {
+	node := w.cg.Nodes[call.Parent()]
+	if node == nil {
+		return
+	}
+
+	for _, edge := range node.Out {
+		if edge.Site != ssa.CallInstruction(call) {
+			continue
+		}
+
+		for _, b := range edge.Callee.Func.Blocks {
+			if len(b.Instrs) == 0 {
+				continue
+			}
+
+			if ret, ok := b.Instrs[len(b.Instrs)-1].(*ssa.Return); ok && nth < len(ret.Results) {
+				w.walk(ret.Results[nth])
+			}
+		}
+	}
+}
@@ -6,19 +6,25 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 
 	"go/ast"
+	"go/build"
 	"go/format"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"golang.org/x/tools/go/callgraph"
 	"golang.org/x/tools/go/loader"
 	"golang.org/x/tools/go/pointer"
 	"golang.org/x/tools/go/ssa"
-	"golang.org/x/tools/go/types"
 )
 
 // Gen is the typeswitch-gen API object.
+// The program is loaded and analyzed once, when first needed, and shared by the later calls
+// until a mode rewrites the files; the next one loads them again.
 type Gen struct {
 	// Users can use Loader as a configuration; Its resulting program is used by Gen.
 	Loader loader.Config
@@ -27,13 +33,51 @@ type Gen struct {
 	FileWriter func(string) io.WriteCloser
 
 	// Main specifies main package for pointer analysis.
-	// If not set, the ad-hoc package created by CreateFromFilenames is used.
+	//
+	// Deprecated: Use Mains; Main is added to them if set.
 	Main string
 
+	// Mains specifies the import paths of the main packages to start the analysis from.
+	// The templates are expanded with the argument types found from any of them.
+	// If not set, the packages imported to Loader are used,
+	// or the ad-hoc package created by CreateFromFilenames if none is imported.
+	Mains []string
+
+	// Tests adds the test main packages of Mains to the entrypoints.
+	// The packages should be loaded with their tests e.g. by Loader.ImportWithTests.
+	Tests bool
+
+	// OnUnmatched specifies how to handle the argument types which match no templates.
+	OnUnmatched UnmatchedPolicy
+
+	// Warn is called with the diagnostics which do not stop Expand,
+	// i.e. *UnmatchedTypeError under UnmatchedWarn and *AmbiguousTemplateError.
+	// They are discarded if Warn is nil.
+	Warn func(error)
+
+	// Analysis specifies the algorithm to find the argument types.
+	Analysis Analysis
+
+	// Debug enables the sanity checks of the SSA functions built.
+	Debug bool
+
+	// InstantiateOnly skips the analysis and expands the templates
+	// only with the types given by //tsgen:instantiate directives.
+	InstantiateOnly bool
+
 	Verbose bool
 
+	resolver   *packageResolver
 	program    *loader.Program
 	ssaProgram *ssa.Program
+	result     *analysisResult
+
+	// markers maps the clauses generated by expand to their marker comments (see markGenerated).
+	markers map[*ast.CaseClause]*ast.CommentGroup
+
+	// rewritten is set when the syntax trees of program are rewritten in place,
+	// after which they no longer match its type information.
+	rewritten bool
 }
 
 // New creates a Gen with some initial configuration.
@@ -45,8 +89,13 @@ func New() *Gen {
 
 // Expand expands type switches in the program with their template case clauses
 // and actual arguments.
-func (g Gen) Expand() error {
-	err := g.buildSSA()
+func (g *Gen) Expand() error {
+	var err error
+	if g.InstantiateOnly {
+		err = g.load()
+	} else {
+		err = g.buildSSA()
+	}
 	if err != nil {
 		return err
 	}
@@ -55,7 +104,7 @@ func (g Gen) Expand() error {
 }
 
 // Sort sorts case clauses in the type switches in the program.
-func (g Gen) Sort() error {
+func (g *Gen) Sort() error {
 	err := g.load()
 	if err != nil {
 		return err
@@ -65,7 +114,7 @@ func (g Gen) Sort() error {
 }
 
 // Scaffold fills type switches with empty case clauses using their subjects type.
-func (g Gen) Scaffold() error {
+func (g *Gen) Scaffold() error {
 	err := g.load()
 	if err != nil {
 		return err
@@ -74,28 +123,227 @@ func (g Gen) Scaffold() error {
 	return g.doFiles(g.scaffoldFileTypeSwitches)
 }
 
-// load loads the program.
+// Clean removes the case clauses generated by Expand from the type switches in the program.
+func (g *Gen) Clean() error {
+	err := g.load()
+	if err != nil {
+		return err
+	}
+
+	return g.doFiles(g.cleanFileTypeSwitches)
+}
+
+// load loads the program if not yet, or again if it has been rewritten.
 func (g *Gen) load() (err error) {
+	if g.rewritten {
+		g.program, g.ssaProgram, g.result = nil, nil, nil
+		g.rewritten = false
+	}
+
+	if g.program != nil {
+		return nil
+	}
+
 	g.program, err = g.Loader.Load()
 	return
 }
 
-// buildSSA loads the program and does SSA analysis.
+// buildSSA loads the program and builds its SSA if not yet.
+// The function bodies are built for the packages having template type switches
+// and the ones imported by the mains directly or indirectly, where the values passed
+// to the templates may be created, except the standard library packages
+// not importing the former. The functions in the other packages are left
+// without bodies, which the analyses treat as external.
 func (g *Gen) buildSSA() error {
 	err := g.load()
 	if err != nil {
 		return err
 	}
 
-	mode := ssa.SanityCheckFunctions
-	g.ssaProgram = ssa.NewProgram(g.program.Fset, mode) // FIXME not sure
-	g.ssaProgram.Build()
+	if g.ssaProgram != nil {
+		return nil
+	}
+
+	var mode ssa.BuilderMode
+	if g.Debug {
+		mode |= ssa.SanityCheckFunctions
+	}
+	g.ssaProgram = ssa.NewProgram(g.program.Fset, mode)
+	for _, pkg := range g.program.AllPackages {
+		if pkg.TransitivelyErrorFree {
+			g.ssaProgram.CreatePackage(pkg.Pkg, pkg.Files, &pkg.Info, pkg.Importable)
+		}
+	}
+
+	templatePkgs := map[*types.Package]bool{}
+	for _, pkg := range g.program.AllPackages {
+		if g.hasTemplates(pkg) {
+			templatePkgs[pkg.Pkg] = true
+		}
+	}
+
+	reachesTemplates := map[*types.Package]bool{}
+	var reaches func(pkg *types.Package) bool
+	reaches = func(pkg *types.Package) bool {
+		if r, ok := reachesTemplates[pkg]; ok {
+			return r
+		}
+
+		reachesTemplates[pkg] = templatePkgs[pkg]
+		for _, imp := range pkg.Imports() {
+			if reaches(imp) {
+				reachesTemplates[pkg] = true
+			}
+		}
+
+		return reachesTemplates[pkg]
+	}
+
+	mains, err := g.mainPkgs()
+	if err != nil {
+		return err
+	}
+
+	fromMains := map[*types.Package]bool{}
+	var visit func(pkg *types.Package)
+	visit = func(pkg *types.Package) {
+		if fromMains[pkg] {
+			return
+		}
+
+		fromMains[pkg] = true
+		for _, imp := range pkg.Imports() {
+			visit(imp)
+		}
+	}
+
+	for _, pkg := range mains {
+		visit(pkg.Pkg)
+		if xtest := g.xtestPkg(pkg); xtest != nil {
+			visit(xtest.Pkg)
+		}
+	}
+
+	for _, pkg := range g.program.AllPackages {
+		ssaPkg := g.ssaPackage(pkg)
+		if ssaPkg == nil {
+			continue
+		}
+
+		needed := templatePkgs[pkg.Pkg] || fromMains[pkg.Pkg] && (!g.isStandard(pkg) || reaches(pkg.Pkg))
+		if !needed {
+			continue
+		}
+
+		// For ValueForExpr
+		if templatePkgs[pkg.Pkg] {
+			ssaPkg.SetDebugMode(true)
+		}
+
+		g.log(nil, nil, "building SSA of %s", pkg)
+		err := g.buildPackage(pkg, ssaPkg)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func (g Gen) writeNode(w io.WriteCloser, node interface{}) error {
-	err := format.Node(w, g.Loader.Fset, node)
+// buildPackage builds ssaPkg of pkg, returning the panic of the SSA builder as an error.
+// The builder panics on the statements it does not support e.g. ranging over functions.
+func (g *Gen) buildPackage(pkg *loader.PackageInfo, ssaPkg *ssa.Package) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: cannot build SSA of %s: %v", g.Loader.Fset.Position(unsupportedPos(pkg)), pkg.Pkg.Path(), r)
+		}
+	}()
+
+	ssaPkg.Build()
+
+	return nil
+}
+
+// unsupportedPos returns the position of the first statement in pkg the SSA builder does not support,
+// i.e. ranging over a function or an integer, or the position of the package if there is none.
+func unsupportedPos(pkg *loader.PackageInfo) token.Pos {
+	if len(pkg.Files) == 0 {
+		return token.NoPos
+	}
+
+	var pos token.Pos
+	for _, file := range pkg.Files {
+		ast.Inspect(file, func(node ast.Node) bool {
+			if pos.IsValid() {
+				return false
+			}
+
+			rs, ok := node.(*ast.RangeStmt)
+			if !ok || rs.X == nil {
+				return true
+			}
+
+			switch t := pkg.TypeOf(rs.X).Underlying().(type) {
+			case *types.Signature:
+				pos = rs.For
+			case *types.Basic:
+				if t.Info()&types.IsInteger != 0 {
+					pos = rs.For
+				}
+			}
+
+			return !pos.IsValid()
+		})
+	}
+
+	if !pos.IsValid() {
+		pos = pkg.Files[0].Package
+	}
+
+	return pos
+}
+
+// isStandard checks if pkg is in the standard library, i.e. in GOROOT.
+func (g *Gen) isStandard(pkg *loader.PackageInfo) bool {
+	if len(pkg.Files) == 0 {
+		return true
+	}
+
+	ctxt := g.Loader.Build
+	if ctxt == nil {
+		ctxt = &build.Default
+	}
+
+	root := filepath.Join(ctxt.GOROOT, "src") + string(filepath.Separator)
+	return strings.HasPrefix(g.tokenFile(pkg.Files[0]).Name(), root)
+}
+
+// hasTemplates checks if pkg has type switches with template clauses.
+func (g *Gen) hasTemplates(pkg *loader.PackageInfo) bool {
+	found := false
+	for _, file := range pkg.Files {
+		forTypeSwitchStmt(file, func(sw *ast.TypeSwitchStmt, path []ast.Node) error {
+			stmt := &typeSwitchStmt{
+				file: file,
+				node: sw,
+				info: pkg.Info,
+			}
+			if stmt.hasTemplates(g) {
+				found = true
+			}
+			return nil
+		})
+
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (g *Gen) writeNode(w io.WriteCloser, fset *token.FileSet, node interface{}) error {
+	err := format.Node(w, fset, node)
 	if err != nil {
 		return err
 	}
@@ -103,26 +351,57 @@ func (g Gen) writeNode(w io.WriteCloser, node interface{}) error {
 	return w.Close()
 }
 
-func (g Gen) callGraphInEdges(funcDecl *ast.FuncDecl) ([]*callgraph.Edge, error) {
-	pta, err := g.pointerAnalysis()
+// callGraphInEdges returns the SSA function of fn,
+// which is either *ast.FuncDecl or *ast.FuncLit, and the call graph edges to it.
+func (g *Gen) callGraphInEdges(fn ast.Node) (*ssa.Function, []*callgraph.Edge, error) {
+	result, err := g.analyze()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	pkg, path, _ := g.program.PathEnclosingInterval(funcDecl.Pos(), funcDecl.End())
+	pkg, path, _ := g.program.PathEnclosingInterval(fn.Pos(), fn.End())
 	ssaFn := ssa.EnclosingFunction(g.ssaPackage(pkg), path)
 	if ssaFn == nil {
-		return nil, fmt.Errorf("BUG: could not find SSA function: %s", funcDecl.Name)
+		return nil, nil, fmt.Errorf("BUG: could not find SSA function at %s", g.Loader.Fset.Position(fn.Pos()))
+	}
+
+	return ssaFn, result.callGraph.CreateNode(ssaFn).In, nil
+}
+
+// ssaParamPos returns the index of the parameter obj in the SSA function fn,
+// in which the receiver of a method is counted, or -1 if not found.
+func ssaParamPos(fn *ssa.Function, obj types.Object) int {
+	for i, p := range fn.Params {
+		if p.Object() == obj {
+			return i
+		}
 	}
 
-	return pta.CallGraph.CreateNode(ssaFn).In, nil
+	return -1
 }
 
-func namedParamPos(name string, list *ast.FieldList) int {
+// callArg returns the argument at the call site for the nth parameter of the callee.
+// The receiver of a method is the 0th parameter, which is not in the arguments
+// for the calls through interfaces.
+func callArg(site ssa.CallInstruction, nth int) ssa.Value {
+	common := site.Common()
+	if common.IsInvoke() {
+		if nth == 0 {
+			return common.Value
+		}
+
+		return common.Args[nth-1]
+	}
+
+	return common.Args[nth]
+}
+
+// paramPos returns the index of the parameter obj in list, or -1 if not found.
+func paramPos(info *types.Info, obj types.Object, list *ast.FieldList) int {
 	var pos int
 	for _, f := range list.List {
 		for _, n := range f.Names {
-			if n.Name == name {
+			if info.Defs[n] == obj {
 				return pos
 			}
 			pos = pos + 1
@@ -132,8 +411,53 @@ func namedParamPos(name string, list *ast.FieldList) int {
 	return -1
 }
 
-func argTypesAt(nth int, edges []*callgraph.Edge) []types.Type {
-	inTypes := []types.Type{}
+// argTuple is the concrete types of the arguments given at a call site,
+// keyed by the subjects of (possibly nested) type switches.
+type argTuple struct {
+	args map[types.Object]types.Type
+
+	// site is the call site where the arguments are given,
+	// or nil if the types are not from a call site.
+	site ssa.CallInstruction
+
+	// directive is the position of the //tsgen:instantiate directive
+	// the types are given by, if any.
+	directive token.Pos
+
+	// analysis is the algorithm which found the types, unless given by a directive.
+	analysis Analysis
+}
+
+func (t argTuple) String() string {
+	ss := []string{}
+	for obj, typ := range t.args {
+		ss = append(ss, obj.Name()+": "+typ.String())
+	}
+	sort.Strings(ss)
+	return "(" + strings.Join(ss, ", ") + ")"
+}
+
+// origin returns how the types in the tuple are found.
+func (t argTuple) origin() string {
+	if t.directive.IsValid() {
+		return "directive"
+	}
+
+	return t.analysis.String()
+}
+
+// argTuplesAt returns the argument type tuples at each call site in edges.
+// params maps the subjects to their parameter index (see callArg),
+// and argTypes maps the argument values to the types they may hold.
+// A call site gives more than one tuple if its arguments may hold more than one type.
+func argTuplesAt(params map[types.Object]int, edges []*callgraph.Edge, argTypes map[ssa.Value][]types.Type) []argTuple {
+	objs := []types.Object{}
+	for obj := range params {
+		objs = append(objs, obj)
+	}
+	sort.Sort(byParamPos{objs, params})
+
+	tuples := []argTuple{}
 
 	for _, edge := range edges {
 		site := edge.Site
@@ -141,81 +465,373 @@ func argTypesAt(nth int, edges []*callgraph.Edge) []types.Type {
 			continue
 		}
 
-		a := site.Common().Args[nth]
-		if mi, ok := a.(*ssa.MakeInterface); ok {
-			inTypes = append(inTypes, mi.X.Type())
+		siteTuples := []argTuple{{args: map[types.Object]types.Type{}, site: site}}
+		for _, obj := range objs {
+			a := callArg(site, params[obj])
+			if len(argTypes[a]) == 0 {
+				continue
+			}
+
+			next := []argTuple{}
+			for _, tuple := range siteTuples {
+				for _, t := range argTypes[a] {
+					newTuple := argTuple{
+						args: map[types.Object]types.Type{obj: t},
+						site: site,
+					}
+					for o, u := range tuple.args {
+						newTuple.args[o] = u
+					}
+					next = append(next, newTuple)
+				}
+			}
+			siteTuples = next
 		}
+
+		tuples = append(tuples, siteTuples...)
 	}
 
-	return inTypes
+	return tuples
+}
+
+type byParamPos struct {
+	objs   []types.Object
+	params map[types.Object]int
 }
 
-func (g Gen) possibleSubjectTypes(pkg *loader.PackageInfo, funcDecl *ast.FuncDecl, typeSwitch *typeSwitchStmt) ([]types.Type, error) {
+func (s byParamPos) Len() int           { return len(s.objs) }
+func (s byParamPos) Swap(i, j int)      { s.objs[i], s.objs[j] = s.objs[j], s.objs[i] }
+func (s byParamPos) Less(i, j int) bool { return s.params[s.objs[i]] < s.params[s.objs[j]] }
+
+// argValueTypes returns the types which the arguments at the call sites in edges may hold.
+// The arguments converted to interfaces right at the call site have their exact types,
+// and the others e.g. passed along by wrapper functions are queried to the pointer analysis.
+func (g *Gen) argValueTypes(params map[types.Object]int, edges []*callgraph.Edge) (map[ssa.Value][]types.Type, error) {
+	argTypes := map[ssa.Value][]types.Type{}
+	values := []ssa.Value{}
+
+	for _, edge := range edges {
+		if edge.Site == nil {
+			continue
+		}
+
+		for _, nth := range params {
+			a := callArg(edge.Site, nth)
+			if mi, ok := a.(*ssa.MakeInterface); ok {
+				argTypes[a] = []types.Type{mi.X.Type()}
+			} else {
+				values = append(values, a)
+			}
+		}
+	}
+
+	if len(values) == 0 {
+		return argTypes, nil
+	}
+
+	valueTypes, err := g.possibleValuesTypes(values)
+	if err != nil {
+		return nil, err
+	}
+
+	for v, ts := range valueTypes {
+		argTypes[v] = ts
+	}
+
+	return argTypes, nil
+}
+
+// possibleArgTuples returns the argument type tuples at the call sites of fn
+// for subjects, which are the parameters the type switches are on.
+// The first subject must be a parameter of fn; the others are
+// ignored if not.
+func (g *Gen) possibleArgTuples(pkg *loader.PackageInfo, fn ast.Node, subjects []types.Object) ([]argTuple, error) {
 	// XXX We can also obtain *loader.PackageInfo by:
 	// pkg, _, _ := g.program.PathEnclosingInterval(file.Pos(), file.End())
 
-	subject := typeSwitch.subject()
-	subjectObj := pkg.Info.Uses[subject] // Where the type switch statement subject is defined
-	// g.log(file, funcDecl, "enclosing func: %s", funcDecl.Type)
-	if subjectObj.Parent() != pkg.Scopes[funcDecl.Type] {
-		return nil, fmt.Errorf("BUG: scope mismatch")
+	ssaFn, in, err := g.callGraphInEdges(fn)
+	if err != nil {
+		return nil, err
 	}
 
-	paramPos := namedParamPos(subject.Name, funcDecl.Type.Params)
+	params := map[types.Object]int{}
+	for i, subjectObj := range subjects {
+		// parameter index of the variable which is subject of the type switch
+		pos := ssaParamPos(ssaFn, subjectObj)
+		if pos < 0 {
+			if i == 0 {
+				return nil, fmt.Errorf("BUG: %s is not a parameter", subjectObj)
+			}
+
+			// A nested type switch on something other than a parameter
+			continue
+		}
+
+		params[subjectObj] = pos
+	}
 
-	// argument index of the variable which is subject of the type switch
-	in, err := g.callGraphInEdges(funcDecl)
+	argTypes, err := g.argValueTypes(params, in)
 	if err != nil {
 		return nil, err
 	}
 
-	return argTypesAt(paramPos, in), nil
+	tuples := argTuplesAt(params, in, argTypes)
+	for i := range tuples {
+		tuples[i].analysis = g.Analysis
+	}
+
+	return tuples, nil
 }
 
-func (g Gen) mainPkg() (*loader.PackageInfo, error) {
-	// Either an ad-hoc package is created
-	// or the package specified by g.Main is loaded
-	var pkg *loader.PackageInfo
-	if len(g.program.Created) > 0 {
-		pkg = g.program.Created[0]
-	} else {
-		pkg = g.program.Imported[g.Main]
+// mainPkgs returns the packages specified by g.Mains and g.Main,
+// or the imported ones or the ad-hoc package created if not set.
+func (g *Gen) mainPkgs() ([]*loader.PackageInfo, error) {
+	mains := g.Mains
+	if g.Main != "" && !slices.Contains(mains, g.Main) {
+		mains = append(mains[:len(mains):len(mains)], g.Main)
+	}
+
+	if len(mains) == 0 {
+		// If imported, the created ones are the external test packages by ImportWithTests
+		if len(g.program.Imported) == 0 {
+			if len(g.program.Created) == 0 {
+				return nil, fmt.Errorf("BUG: no package is imported nor created")
+			}
+
+			return []*loader.PackageInfo{g.program.Created[0]}, nil
+		}
+
+		paths := []string{}
+		for path := range g.program.Imported {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		pkgs := []*loader.PackageInfo{}
+		for _, path := range paths {
+			pkgs = append(pkgs, g.program.Imported[path])
+		}
+
+		return pkgs, nil
 	}
 
-	if pkg == nil {
-		return nil, fmt.Errorf("BUG: no package is created and main %q is not imported")
+	pkgs := []*loader.PackageInfo{}
+	for _, path := range mains {
+		pkg := g.program.Imported[path]
+		if pkg == nil {
+			return nil, fmt.Errorf("BUG: main %q is not imported", path)
+		}
+
+		pkgs = append(pkgs, pkg)
+	}
+
+	return pkgs, nil
+}
+
+// xtestPkg returns the external test package of pkg, e.g. foo_test for foo, if loaded.
+func (g *Gen) xtestPkg(pkg *loader.PackageInfo) *loader.PackageInfo {
+	for _, created := range g.program.Created {
+		if created.Pkg.Path() == pkg.Pkg.Path()+"_test" {
+			return created
+		}
 	}
 
-	return pkg, nil
+	return nil
 }
 
-func (g Gen) ssaPackage(pkg *loader.PackageInfo) *ssa.Package {
+func (g *Gen) ssaPackage(pkg *loader.PackageInfo) *ssa.Package {
 	return g.ssaProgram.Package(pkg.Pkg)
 }
 
-func (g Gen) pointerAnalysis() (*pointer.Result, error) {
-	pkg, err := g.mainPkg()
+// possibleValueTypes returns the dynamic types which value may hold,
+// or the value value points to if indirect is true,
+// in the sorted order.
+func (g *Gen) possibleValueTypes(value ssa.Value, indirect bool) ([]types.Type, error) {
+	result, err := g.analyze()
 	if err != nil {
 		return nil, err
 	}
-	ssaPkg := g.ssaPackage(pkg)
 
-	var ssaMain *ssa.Package
-	if _, ok := ssaPkg.Members["main"]; ok {
-		ssaMain = ssaPkg
-	} else {
-		ssaMain = g.ssaProgram.CreateTestMainPackage(ssaPkg)
-		if ssaMain == nil {
-			return nil, fmt.Errorf("%s does not have main function nor tests", pkg)
+	return result.valueTypes(value, indirect), nil
+}
+
+// possibleValuesTypes is possibleValueTypes for multiple values at once.
+func (g *Gen) possibleValuesTypes(values []ssa.Value) (map[ssa.Value][]types.Type, error) {
+	result, err := g.analyze()
+	if err != nil {
+		return nil, err
+	}
+
+	valueTypes := map[ssa.Value][]types.Type{}
+	for _, v := range values {
+		valueTypes[v] = result.valueTypes(v, false)
+	}
+
+	return valueTypes, nil
+}
+
+// dynamicTypes returns the dynamic types of the interface ptr in the sorted order.
+func dynamicTypes(ptr pointer.Pointer) []types.Type {
+	inTypes := []types.Type{}
+	ptr.DynamicTypes().Iterate(func(t types.Type, _ interface{}) {
+		inTypes = append(inTypes, t)
+	})
+
+	sort.Sort(byTypeString(inTypes))
+
+	return inTypes
+}
+
+type byTypeString []types.Type
+
+func (s byTypeString) Len() int           { return len(s) }
+func (s byTypeString) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTypeString) Less(i, j int) bool { return s[i].String() < s[j].String() }
+
+// ssaMainPackages returns the SSA packages having the main functions to start the analysis from,
+// which are the main packages, and the test main packages created for them if g.Tests is set.
+// A package without main function is started from its tests anyway.
+func (g *Gen) ssaMainPackages() ([]*ssa.Package, error) {
+	pkgs, err := g.mainPkgs()
+	if err != nil {
+		return nil, err
+	}
+
+	mains := []*ssa.Package{}
+	for _, pkg := range pkgs {
+		ssaPkg := g.ssaPackage(pkg)
+
+		hasMain := ssaPkg.Func("main") != nil
+		if hasMain {
+			mains = append(mains, ssaPkg)
+			if !g.Tests {
+				continue
+			}
 		}
+
+		testPkgs := []*ssa.Package{ssaPkg}
+		if xtest := g.xtestPkg(pkg); xtest != nil {
+			testPkgs = append(testPkgs, g.ssaPackage(xtest))
+		}
+
+		testMain, err := g.createTestMain(testPkgs...)
+		if err != nil {
+			return nil, err
+		}
+		if testMain != nil {
+			mains = append(mains, testMain)
+		} else if !hasMain {
+			g.log(nil, nil, "%s does not have main function nor tests", pkg)
+		}
+	}
+
+	if len(mains) == 0 {
+		return nil, fmt.Errorf("no main function nor tests found in %s", pkgs)
+	}
+
+	return mains, nil
+}
+
+// pointerConfig returns the configuration for the pointer analysis
+// on the main packages.
+func (g *Gen) pointerConfig() (*pointer.Config, error) {
+	mains, err := g.ssaMainPackages()
+	if err != nil {
+		return nil, err
 	}
 
 	conf := &pointer.Config{
 		BuildCallGraph: true,
-		Mains:          []*ssa.Package{ssaMain},
+		Mains:          mains,
+	}
+
+	return conf, nil
+}
+
+// subjectValue returns the SSA value of the type switch subject,
+// which is in the function at path.
+// If indirect is true, the value is the address of the subject.
+func (g *Gen) subjectValue(pkg *loader.PackageInfo, path []ast.Node, stmt *typeSwitchStmt) (value ssa.Value, indirect bool, err error) {
+	ssaFn := ssa.EnclosingFunction(g.ssaPackage(pkg), path)
+	if ssaFn == nil {
+		return nil, false, g.errorf(stmt.node, "could not find SSA function")
+	}
+
+	value, indirect = ssaFn.ValueForExpr(stmt.subject())
+	if value == nil {
+		return nil, false, g.errorf(stmt.node, "could not find SSA value of %s", g.showNode(stmt.subject()))
+	}
+
+	return value, indirect, nil
+}
+
+// enclosingParamFunc returns the function in path, which is innermost first,
+// whose parameter is obj. Returns nil if obj is not a parameter.
+func enclosingParamFunc(pkg *loader.PackageInfo, path []ast.Node, obj types.Object) ast.Node {
+	if obj == nil {
+		return nil
 	}
 
-	return pointer.Analyze(conf)
+	for _, node := range path {
+		if ft := funcType(node); ft != nil && paramPos(&pkg.Info, obj, ft.Params) >= 0 {
+			return node
+		}
+	}
+
+	return nil
+}
+
+// funcType returns the type of fn if it is either *ast.FuncDecl or *ast.FuncLit.
+func funcType(fn ast.Node) *ast.FuncType {
+	switch fn := fn.(type) {
+	case *ast.FuncDecl:
+		return fn.Type
+	case *ast.FuncLit:
+		return fn.Type
+	}
+
+	return nil
+}
+
+// forTypeSwitchStmt calls proc for each type switch statement in file at any depth,
+// with the path to it from file, innermost first.
+// The inner statements come first, so rewriting the outer ones
+// does not detach the inner ones from file.
+func forTypeSwitchStmt(file *ast.File, proc func(*ast.TypeSwitchStmt, []ast.Node) error) error {
+	type found struct {
+		node *ast.TypeSwitchStmt
+		path []ast.Node
+	}
+
+	founds := []found{}
+	stack := []ast.Node{}
+
+	ast.Inspect(file, func(node ast.Node) bool {
+		if node == nil {
+			stack = stack[:len(stack)-1]
+			return false
+		}
+
+		if sw, ok := node.(*ast.TypeSwitchStmt); ok {
+			path := make([]ast.Node, len(stack))
+			for i, n := range stack {
+				path[len(stack)-1-i] = n
+			}
+			founds = append(founds, found{node: sw, path: path})
+		}
+
+		stack = append(stack, node)
+		return true
+	})
+
+	for i := len(founds) - 1; i >= 0; i-- {
+		err := proc(founds[i].node, founds[i].path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // doFiles is a utility method which calls rewrite for each *ast.File file in the program loaded
@@ -223,7 +839,7 @@ func (g Gen) pointerAnalysis() (*pointer.Result, error) {
 // rewrite is expected to modify the *ast.File file given.
 // It uses g.FileWriter to determine if the file is in target or not.
 // Must be called after g.load().
-func (g Gen) doFiles(rewrite func(*loader.PackageInfo, *ast.File) error) (err error) {
+func (g *Gen) doFiles(rewrite func(*loader.PackageInfo, *ast.File) error) (err error) {
 	for _, pkg := range g.program.AllPackages {
 		for _, file := range pkg.Files {
 			w := g.FileWriter(filepath.Clean(g.tokenFile(file).Name()))
@@ -231,12 +847,23 @@ func (g Gen) doFiles(rewrite func(*loader.PackageInfo, *ast.File) error) (err er
 				continue
 			}
 
+			g.rewritten = true
+			g.markers = nil
+
 			err = rewrite(pkg, file)
 			if err != nil {
 				return
 			}
 
-			err = g.writeNode(w, file)
+			fset, written := g.Loader.Fset, file
+			if len(g.markers) > 0 {
+				fset, written, err = g.placeMarkers(file)
+				if err != nil {
+					return
+				}
+			}
+
+			err = g.writeNode(w, fset, written)
 			if err != nil {
 				return
 			}
@@ -246,11 +873,24 @@ func (g Gen) doFiles(rewrite func(*loader.PackageInfo, *ast.File) error) (err er
 	return nil
 }
 
-func (g Gen) tokenFile(node ast.Node) *token.File {
+func (g *Gen) tokenFile(node ast.Node) *token.File {
 	return g.Loader.Fset.File(node.Pos())
 }
 
-func (g Gen) log(file *ast.File, node ast.Node, pattern string, args ...interface{}) {
+// errorf returns an error prefixed with the position of node.
+func (g *Gen) errorf(node ast.Node, pattern string, args ...interface{}) error {
+	pos := g.Loader.Fset.Position(node.Pos())
+	return fmt.Errorf("%s: %s", pos, fmt.Sprintf(pattern, args...))
+}
+
+// warn reports err by g.Warn.
+func (g *Gen) warn(err error) {
+	if g.Warn != nil {
+		g.Warn(err)
+	}
+}
+
+func (g *Gen) log(file *ast.File, node ast.Node, pattern string, args ...interface{}) {
 	if g.Verbose == false {
 		return
 	}
@@ -272,7 +912,7 @@ func (g Gen) log(file *ast.File, node ast.Node, pattern string, args ...interfac
 	fmt.Fprintf(os.Stderr, "%s: "+pattern+"\n", args...)
 }
 
-func (g Gen) showNode(node ast.Node) string {
+func (g *Gen) showNode(node ast.Node) string {
 	var buf bytes.Buffer
 	format.Node(&buf, g.Loader.Fset, node)
 	return buf.String()
@@ -3,9 +3,18 @@ package gen
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
-	"golang.org/x/tools/go/types"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -19,27 +28,49 @@ func (nc nopCloser) Close() error {
 	return nil
 }
 
-func TestGen(t *testing.T) {
-	var err error
+// sameFile reports whether the paths refer to the same file;
+// the loader passes the absolute paths to FileWriter.
+func sameFile(path, file string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	file, err = filepath.Abs(file)
+	if err != nil {
+		return false
+	}
+	return path == file
+}
 
+// expandFile expands the file at path, which is loaded alone, and returns the result written for it.
+// configure sets up the Gen before expanding, if not nil.
+func expandFile(t *testing.T, path string, configure func(*Gen)) string {
 	out := new(bytes.Buffer)
 
 	g := New()
 	g.Verbose = testing.Verbose()
-	g.FileWriter = func(path string) io.WriteCloser {
-		if path == "testdata/e.go" {
+	if configure != nil {
+		configure(g)
+	}
+	g.FileWriter = func(p string) io.WriteCloser {
+		if sameFile(p, path) {
 			return nopCloser{out}
 		}
 
 		return nil
 	}
-	err = g.Loader.CreateFromFilenames("", "./testdata/e.go")
-	assert.NoError(t, err)
+	g.Loader.CreateFromFilenames("", path)
 
-	err = g.Expand()
-	assert.NoError(t, err)
+	err := g.Expand()
+	require.NoError(t, err)
 
 	t.Log(out.String())
+
+	return out.String()
+}
+
+func TestGen(t *testing.T) {
+	expandFile(t, "testdata/e.go", nil)
 }
 
 func TestIsTypeVariable(t *testing.T) {
@@ -64,3 +95,624 @@ func TestIsTypeVariable(t *testing.T) {
 	assert.True(t, gen.isTypeVariable(typeDefs["NumberT"]))
 	assert.False(t, gen.isTypeVariable(typeDefs["NonTypeVariableT"]))
 }
+
+func TestExpandNested(t *testing.T) {
+	result := expandFile(t, "testdata/nested.go", nil)
+
+	assert.Contains(t, result, "\tcase []string:\n\t\t// +tsgen generated from []T\n\t\tswitch cb := cb.(type) {\n\t\tcase func(int, string):")
+	assert.Contains(t, result, "\tcase []bool:\n\t\t// +tsgen generated from []T\n\t\tswitch cb := cb.(type) {\n\t\tcase func(int, bool):")
+	assert.Contains(t, result, "\tcase []T:\n\t\tswitch cb := cb.(type) {\n\t\tcase func(int, T):")
+
+	// Nested in a concrete clause, expanded on its own
+	assert.Contains(t, result, "\t\tswitch b := b.(type) {\n\t\tcase []string:\n\t\t\t// +tsgen generated from []T\n\t\t\t_ = len(b)\n")
+}
+
+func TestExpandDepth(t *testing.T) {
+	result := expandFile(t, "testdata/depth.go", nil)
+
+	assert.Contains(t, result, "case map[string]int:")
+	assert.Contains(t, result, "case map[string]bool:")
+	assert.Contains(t, result, "case map[string]string:")
+	assert.Contains(t, result, "case map[string]byte:")
+}
+
+func TestExpandSubjectForms(t *testing.T) {
+	result := expandFile(t, "testdata/forms.go", nil)
+
+	assert.Contains(t, result, "\tswitch x.(type) {\n\tcase map[string]int:\n\t\t// +tsgen generated from map[string]T\n\t\tvar t int")
+	assert.Contains(t, result, "\tswitch x := (x).(type) {\n\tcase map[string]bool:")
+}
+
+func TestExpandLocals(t *testing.T) {
+	result := expandFile(t, "testdata/locals.go", nil)
+
+	assert.Contains(t, result, "\tswitch v := v.(type) {\n\tcase map[string]int64:\n\t\t// +tsgen generated from map[string]T\n\t\t_ = v\n\tcase map[string]int32:")
+	assert.Contains(t, result, "\tswitch v := b.v.(type) {\n\tcase map[string]int8:")
+	assert.Contains(t, result, "\tswitch v := (<-ch).(type) {\n\tcase map[string]int16:")
+}
+
+func TestExpandWrapper(t *testing.T) {
+	result := expandFile(t, "testdata/wrapper.go", nil)
+
+	for _, typ := range []string{"int", "bool", "byte", "int8", "int16"} {
+		assert.Contains(t, result, "\tcase map[string]"+typ+":")
+	}
+}
+
+func TestExpandMethods(t *testing.T) {
+	result := expandFile(t, "testdata/methods.go", nil)
+
+	for _, typ := range []string{"int", "bool", "byte", "int8"} {
+		assert.Contains(t, result, "\tcase map[string]"+typ+":\n\t\t// +tsgen generated from map[string]T\n\t\tks := []string{}")
+	}
+
+	assert.Contains(t, result, "\t\tswitch a := a.(type) {\n\t\tcase map[string]int32:\n\t\t\t// +tsgen generated from map[string]T\n\t\t\t_ = a\n\t\tcase map[string]int16:")
+	assert.Contains(t, result, "\tswitch a := args[0].(type) {\n\tcase map[string]int32:\n\t\t// +tsgen generated from map[string]T\n\t\t_ = a\n\tcase map[string]int16:")
+}
+
+func TestExpandAnalysis(t *testing.T) {
+	expand := func(analysis Analysis, file string) string {
+		return expandFile(t, file, func(g *Gen) {
+			g.Analysis = analysis
+		})
+	}
+
+	for _, analysis := range []Analysis{AnalysisCHA, AnalysisRTA, AnalysisVTA} {
+		result := expand(analysis, "testdata/wrapper.go")
+		for _, typ := range []string{"int", "bool", "byte", "int8", "int16"} {
+			assert.Contains(t, result, "\tcase map[string]"+typ+":", analysis.String())
+		}
+
+		result = expand(analysis, "testdata/methods.go")
+		for _, typ := range []string{"int", "bool", "byte", "int8", "int16", "int32"} {
+			assert.Contains(t, result, "\tcase map[string]"+typ+":", analysis.String())
+		}
+
+		result = expand(analysis, "testdata/locals.go")
+		for _, typ := range []string{"int8", "int16", "int32", "int64"} {
+			assert.Contains(t, result, "\tcase map[string]"+typ+":", analysis.String())
+		}
+
+		result = expand(analysis, "testdata/closure.go")
+		for _, typ := range []string{"int", "bool", "byte", "int8"} {
+			assert.Contains(t, result, "\tcase map[string]"+typ+":", analysis.String())
+		}
+	}
+}
+
+func TestExpandAnalyzeOnce(t *testing.T) {
+	var err error
+
+	g := New()
+	g.Verbose = testing.Verbose()
+	g.FileWriter = func(path string) io.WriteCloser {
+		if sameFile(path, "testdata/methods.go") {
+			return nopCloser{new(bytes.Buffer)}
+		}
+
+		return nil
+	}
+	g.Loader.CreateFromFilenames("", "./testdata/methods.go")
+
+	err = g.Expand()
+	require.NoError(t, err)
+
+	// Shared by all the type switches
+	result := g.result
+	require.NotNil(t, result)
+
+	r, err := g.analyze()
+	require.NoError(t, err)
+	assert.True(t, r == result)
+}
+
+func TestModesOnOneGen(t *testing.T) {
+	var out *bytes.Buffer
+
+	g := New()
+	g.Verbose = testing.Verbose()
+	g.FileWriter = func(path string) io.WriteCloser {
+		if sameFile(path, "testdata/methods.go") {
+			out = new(bytes.Buffer)
+			return nopCloser{out}
+		}
+
+		return nil
+	}
+	g.Loader.CreateFromFilenames("", "./testdata/methods.go")
+
+	err := g.Expand()
+	require.NoError(t, err)
+
+	expanded := out.String()
+	require.Contains(t, expanded, "// +tsgen generated from")
+
+	// The program is loaded again after being rewritten
+	err = g.Expand()
+	require.NoError(t, err)
+	assert.Equal(t, expanded, out.String())
+
+	err = g.Sort()
+	require.NoError(t, err)
+
+	err = g.Clean()
+	require.NoError(t, err)
+	assert.NotContains(t, out.String(), "// +tsgen generated from")
+}
+
+func TestExpandMains(t *testing.T) {
+	gopath, err := filepath.Abs("testdata/mains")
+	require.NoError(t, err)
+
+	file := filepath.Join(gopath, "src", "mains", "keys", "keys.go")
+
+	// Find the packages in GOPATH, not by the go command in this module
+	t.Setenv("GO111MODULE", "off")
+
+	for _, analysis := range []Analysis{AnalysisPointer, AnalysisCHA, AnalysisRTA, AnalysisVTA} {
+		out := new(bytes.Buffer)
+		warnings := []error{}
+
+		ctxt := build.Default
+		ctxt.GOPATH = gopath
+
+		g := New()
+		g.Verbose = testing.Verbose()
+		g.Analysis = analysis
+		g.Loader.Build = &ctxt
+		g.Warn = func(err error) {
+			warnings = append(warnings, err)
+		}
+		g.FileWriter = func(path string) io.WriteCloser {
+			if sameFile(path, file) {
+				return nopCloser{out}
+			}
+
+			return nil
+		}
+		g.Mains = []string{"mains/cmd/a", "mains/cmd/b"}
+		for _, path := range g.Mains {
+			g.Loader.Import(path)
+		}
+
+		err = g.Expand()
+		require.NoError(t, err)
+
+		result := out.String()
+		t.Log(result)
+
+		// The union of the types from the both
+		for _, typ := range []string{"int", "bool", "[]byte", "float64"} {
+			assert.Contains(t, result, "\tcase map[string]"+typ+":", analysis.String())
+		}
+
+		// Unexported in mains/decode
+		assert.NotContains(t, result, "secret", analysis.String())
+		if assert.Len(t, warnings, 1, analysis.String()) {
+			assert.IsType(t, &UnexportedTypeError{}, warnings[0])
+		}
+	}
+}
+
+func TestExpandMain(t *testing.T) {
+	gopath, err := filepath.Abs("testdata/mains")
+	require.NoError(t, err)
+
+	file := filepath.Join(gopath, "src", "mains", "keys", "keys.go")
+
+	t.Setenv("GO111MODULE", "off")
+
+	out := new(bytes.Buffer)
+
+	ctxt := build.Default
+	ctxt.GOPATH = gopath
+
+	g := New()
+	g.Verbose = testing.Verbose()
+	g.Loader.Build = &ctxt
+	g.FileWriter = func(path string) io.WriteCloser {
+		if sameFile(path, file) {
+			return nopCloser{out}
+		}
+
+		return nil
+	}
+
+	// Deprecated, but still used along with Mains
+	g.Main = "mains/cmd/b"
+	g.Mains = []string{"mains/cmd/a"}
+	g.Loader.Import("mains/cmd/a")
+	g.Loader.Import("mains/cmd/b")
+
+	err = g.Expand()
+	require.NoError(t, err)
+
+	result := out.String()
+	t.Log(result)
+
+	for _, typ := range []string{"int", "bool"} {
+		assert.Contains(t, result, "\tcase map[string]"+typ+":")
+	}
+}
+
+func TestExpandModule(t *testing.T) {
+	dir, err := filepath.Abs("testdata/module")
+	require.NoError(t, err)
+
+	file := filepath.Join(dir, "keys", "keys.go")
+
+	// The dependencies are in the vendor directory
+	t.Setenv("GOFLAGS", "-mod=vendor")
+
+	out := new(bytes.Buffer)
+
+	g := New()
+	g.Verbose = testing.Verbose()
+	g.Loader.Cwd = dir
+	g.FileWriter = func(path string) io.WriteCloser {
+		if sameFile(path, file) {
+			return nopCloser{out}
+		}
+
+		return nil
+	}
+
+	pkgs, err := g.ResolvePackages("./...")
+	require.NoError(t, err)
+
+	paths := []string{}
+	for _, pkg := range pkgs {
+		paths = append(paths, pkg.ImportPath)
+		g.Loader.Import(pkg.ImportPath)
+	}
+	assert.Equal(t, []string{"example.com/module/cmd", "example.com/module/keys"}, paths)
+
+	g.Mains = []string{"example.com/module/cmd"}
+
+	err = g.Expand()
+	require.NoError(t, err)
+
+	result := out.String()
+	t.Log(result)
+
+	// Imported from the vendor directory
+	assert.Contains(t, result, "import \"example.com/dep\"")
+	assert.Contains(t, result, "\tcase map[string]*dep.Value:")
+	assert.Contains(t, result, "\tcase map[string]int:")
+}
+
+func TestExpandUnmatched(t *testing.T) {
+	for _, policy := range []UnmatchedPolicy{UnmatchedFatal, UnmatchedWarn, UnmatchedIgnore} {
+		var err error
+
+		warnings := []error{}
+
+		g := New()
+		g.Verbose = testing.Verbose()
+		g.OnUnmatched = policy
+		g.Warn = func(err error) {
+			warnings = append(warnings, err)
+		}
+		g.FileWriter = func(path string) io.WriteCloser {
+			if sameFile(path, "testdata/unmatched.go") {
+				return nopCloser{new(bytes.Buffer)}
+			}
+
+			return nil
+		}
+		g.Loader.CreateFromFilenames("", "./testdata/unmatched.go")
+
+		err = g.Expand()
+		if policy == UnmatchedIgnore {
+			assert.NoError(t, err)
+			assert.Empty(t, warnings)
+			continue
+		}
+
+		if policy == UnmatchedWarn {
+			require.NoError(t, err)
+			require.Len(t, warnings, 1)
+			err = warnings[0]
+		}
+
+		require.IsType(t, &UnmatchedTypeError{}, err)
+		t.Log(err)
+
+		uerr := err.(*UnmatchedTypeError)
+		assert.Equal(t, "[]int", uerr.Type.String())
+		assert.Equal(t, 20, uerr.Pos.Line)
+		if assert.Len(t, uerr.Sites, 1) {
+			assert.Equal(t, 15, uerr.Sites[0].Line)
+		}
+		// Not including the concrete case reader
+		if assert.Len(t, uerr.Templates, 1) {
+			assert.Equal(t, "map[string]testdata.T", uerr.Templates[0].Pattern.String())
+			assert.Equal(t, 21, uerr.Templates[0].Pos.Line)
+			assert.Equal(t, 7, uerr.Templates[0].Pos.Column)
+		}
+	}
+}
+
+func TestExpandOrdinary(t *testing.T) {
+	result := expandFile(t, "testdata/ordinary.go", func(g *Gen) {
+		g.OnUnmatched = UnmatchedFatal
+	})
+
+	// The type switches without templates are left as they are,
+	// and the one whose default clause handles map[string]int too
+	src, err := ioutil.ReadFile("testdata/ordinary.go")
+	require.NoError(t, err)
+	assert.Equal(t, string(src), result)
+}
+
+func TestExpandImports(t *testing.T) {
+	var err error
+
+	out := new(bytes.Buffer)
+
+	g := New()
+	g.Verbose = testing.Verbose()
+	g.FileWriter = func(path string) io.WriteCloser {
+		if sameFile(path, "testdata/imports/keys.go") {
+			return nopCloser{out}
+		}
+
+		return nil
+	}
+	g.Loader.CreateFromFilenames("", "./testdata/imports/keys.go", "./testdata/imports/main.go")
+
+	err = g.Expand()
+	require.NoError(t, err)
+
+	result := out.String()
+	t.Log(result)
+
+	assert.Contains(t, result, "import (\n\t\"container/list\"\n\tring2 \"container/ring\"\n\t\"io\"\n)")
+	assert.Contains(t, result, "\tcase map[string]*list.List:")
+	assert.Contains(t, result, "\tcase map[string]*ring2.Ring:")
+	assert.Contains(t, result, "\tcase map[string]io.Reader:")
+	assert.Contains(t, result, "\tcase map[string][]*list.List:")
+	assert.Contains(t, result, "\tcase map[string]map[io.Reader]chan<- *ring2.Ring:")
+	assert.Contains(t, result, "\tcase map[string]*local:")
+}
+
+func TestExpandConstraints(t *testing.T) {
+	result := expandFile(t, "testdata/constraints.go", nil)
+
+	assert.Contains(t, result, "\tcase []int:\n\t\t// +tsgen generated from []NumT\n\t\tvar s int\n")
+	assert.Contains(t, result, "\tcase []float32:\n\t\t// +tsgen generated from []NumT\n\t\tvar s float32\n")
+	assert.Contains(t, result, "\tcase []*buffer:\n\t\t// +tsgen generated from []ReaderT\n\t\t_ = a\n")
+	assert.Contains(t, result, "\tcase []conn:\n\t\t// +tsgen generated from []CloserT\n\t\tfor _, c := range a {\n\t\t\tc.Close()")
+	assert.Contains(t, result, "\tcase []bool:\n\t\t// +tsgen generated from []T\n\t\t_ = len(a)")
+	assert.Equal(t, 1, strings.Count(result, "case []int:"))
+	assert.NotContains(t, result, "generated from []TypoT")
+}
+
+func TestExpandMultiplePatterns(t *testing.T) {
+	result := expandFile(t, "testdata/multi.go", nil)
+
+	// Bodies depending on the type variables are generated per binding
+	assert.Contains(t, result, "\tcase map[string]int, map[int]int:\n\t\t// +tsgen generated from map[string]T, map[int]T\n\t\tvar values []int\n")
+	// in which the subject is rebound if only one type is left
+	assert.Contains(t, result, "\tcase map[string]io.Reader:\n\t\t// +tsgen generated from map[string]T, map[int]T\n\t\t{\n\t\t\tm := interface{}(m)\n\t\t\tvar values []io.Reader\n")
+	assert.Contains(t, result, "\tcase map[int]bool:\n\t\t// +tsgen generated from map[string]T, map[int]T\n\t\t{\n\t\t\tm := interface{}(m)\n\t\t\tvar values []bool\n")
+
+	// The others are merged into one clause
+	assert.Contains(t, result, "\tcase map[string]int, map[int]bool:\n\t\t// +tsgen generated from map[string]T, map[int]T, []byte\n\t\treturn lengthOf(m)\n")
+	assert.Contains(t, result, "\tcase map[string]T, map[int]T, []byte:\n")
+}
+
+func TestExpandRebind(t *testing.T) {
+	result := expandFile(t, "testdata/rebind.go", nil)
+
+	// The subject keeps the type of the switch expression as in the template
+	assert.Contains(t, result, "\tcase []int:\n\t\t// +tsgen generated from []T, map[string]T\n\t\t{\n\t\t\tv := interface{}(v)\n\t\t\tif s, ok := v.(fmt.Stringer); ok {\n")
+	assert.Contains(t, result, "\tcase map[string]bool:\n\t\t// +tsgen generated from []T, map[string]T\n\t\t{\n\t\t\tv := interface{}(v)\n")
+	assert.Contains(t, result, "\t\t\tvar zero bool\n\t\t\tv = zero\n")
+
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "rebind.go", result, 0)
+	require.NoError(t, err)
+
+	conf := types.Config{Importer: importer.Default()}
+	_, err = conf.Check("testdata", fset, []*ast.File{file}, nil)
+	assert.NoError(t, err)
+}
+
+func TestExpandAlias(t *testing.T) {
+	result := expandFile(t, "testdata/alias.go", nil)
+
+	assert.Contains(t, result, "\tcase MyMap:\n\t\t// +tsgen generated from map[string]T\n\t\tvar v int\n")
+	assert.Contains(t, result, "\tcase func(any) bool:\n\t\t// +tsgen generated from func(any) T\n\t\tvar r bool = f(nil)\n")
+}
+
+func TestExpandRangeFunc(t *testing.T) {
+	g := New()
+	g.Verbose = testing.Verbose()
+	g.FileWriter = func(path string) io.WriteCloser {
+		return nil
+	}
+	g.Loader.CreateFromFilenames("", "testdata/rangefunc.go")
+
+	// Not supported by the SSA builder
+	err := g.Expand()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "testdata/rangefunc.go:12:3: cannot build SSA of testdata: ")
+}
+
+func TestExpandBinding(t *testing.T) {
+	result := expandFile(t, "testdata/binding.go", nil)
+
+	// func(T) T does not match func(string) bool
+	assert.Contains(t, result, "\tcase func(int) int:\n\t\t// +tsgen generated from func(T) T\n\t\tvar x int\n")
+	assert.Contains(t, result, "\tcase func(string) bool:\n\t\t// +tsgen generated from func(T) _T\n\t\tvar x string\n")
+	assert.Equal(t, 1, strings.Count(result, "case func(string) bool:"))
+
+	// Wildcards match without being bound
+	assert.Contains(t, result, "\tcase []int:\n\t\t// +tsgen generated from []_T\n\t\t_ = c[i]\n")
+	assert.Contains(t, result, "\tcase map[bool]string:\n\t\t// +tsgen generated from map[T]_T\n\t\tvar k bool\n")
+}
+
+func TestExpandPatterns(t *testing.T) {
+	result := expandFile(t, "testdata/patterns.go", func(g *Gen) {
+		g.OnUnmatched = UnmatchedIgnore
+	})
+
+	// Array lengths
+	assert.Contains(t, result, "\tcase [3]int:\n\t\t// +tsgen generated from [3]T\n\t\t_ = a[2]\n")
+	assert.Contains(t, result, "\tcase [5]bool:\n\t\t// +tsgen generated from [N]T\n\t\tvar b [5]bool\n")
+	assert.Contains(t, result, "\tcase [2]string:\n\t\t// +tsgen generated from [N]T\n\t\tvar b [2]string\n")
+
+	// Channel directions
+	assert.Contains(t, result, "\tcase chan int:\n\t\t// +tsgen generated from <-chan T\n\t\tvar x int = <-c\n")
+	assert.Contains(t, result, "\tcase <-chan bool:\n\t\t// +tsgen generated from <-chan T\n\t\tvar x bool = <-c\n")
+	assert.NotContains(t, result, "case chan<- string:")
+	assert.Contains(t, result, "\tcase chan int8:\n\t\t// +tsgen generated from chan T\n\t\treturn cap(c)\n")
+	assert.Contains(t, result, "\tcase <-chan int16:\n\t\t// +tsgen generated from chan T\n\t\treturn cap(c)\n")
+	assert.Contains(t, result, "\tcase chan<- int32:\n\t\t// +tsgen generated from chan T\n\t\treturn cap(c)\n")
+
+	// Variadic parameters
+	assert.Contains(t, result, "\tcase func(...int):\n\t\t// +tsgen generated from func(...T)\n\t\tf()\n")
+	assert.Contains(t, result, "\tcase func([]bool):\n\t\t// +tsgen generated from func([]T)\n\t\tf(nil)\n")
+
+	// Struct field names and tags
+	assert.Contains(t, result, "\tcase struct {\n\t\tName int\n\t}:\n")
+	assert.Contains(t, result, "\tcase struct {\n\t\tName bool \"json:\\\"name\\\"\"\n\t}:\n")
+	assert.NotContains(t, result, "\t\tValue string\n\t}:\n")
+}
+
+func TestExpandUnderlying(t *testing.T) {
+	result := expandFile(t, "testdata/underlying.go", func(g *Gen) {
+		g.OnUnmatched = UnmatchedIgnore
+	})
+
+	assert.Contains(t, result, "\tcase in1:\n\t\t// +tsgen generated from map[string]T\n\t\tfor k := range map[string][]int(m) {\n")
+	assert.Contains(t, result, "\t\tvar x map[string][]int = map[string][]int(m)\n\t\t_ = x\n\t\tm = nil\n")
+	assert.Contains(t, result, "\tcase map[string]string:\n\t\t// +tsgen generated from map[string]T\n\t\tfor k := range m {\n")
+	assert.Contains(t, result, "\tcase list:\n\t\t// +tsgen generated from []E\n\t\t_ = []bool(a)[0]\n")
+
+	// Converted to interfaces with the named type
+	assert.Contains(t, result, "\t\tfor k := range map[string][]int(m) {\n\t\t\tshow(k, m)\n\t\t}\n\t\tvar v interface{} = m\n\t\t_ = v\n\t\treturn m\n")
+
+	assert.Contains(t, result, "\tcase map[string]T: // +tsgen underlying\n")
+
+	// Not enabled in keysExact
+	assert.Equal(t, 2, strings.Count(result, "case in1:"))
+}
+
+func TestExpandScope(t *testing.T) {
+	result := expandFile(t, "testdata/scope.go", nil)
+
+	assert.Contains(t, result, "\tcase []map[string]io.Reader:\n\t\t// +tsgen generated from []T\n\t\tvar x map[string]io.Reader\n")
+
+	// Identifiers named T not referring to the type variable are kept
+	assert.Equal(t, 2, strings.Count(result, "h := holder{T: 1}\n\t\t_ = h.T\n"))
+	assert.Equal(t, 2, strings.Count(result, "T := 2\n\t\t\t_ = T\n"))
+	assert.Equal(t, 2, strings.Count(result, "\tT:\n\t\tfor range v {\n\t\t\tbreak T\n"))
+}
+
+func TestExpandInstantiate(t *testing.T) {
+	expand := func(instantiateOnly bool) string {
+		return expandFile(t, "testdata/instantiate.go", func(g *Gen) {
+			g.InstantiateOnly = instantiateOnly
+		})
+	}
+
+	analyzed, instantiated := expand(false), expand(true)
+
+	for _, result := range []string{analyzed, instantiated} {
+		assert.Contains(t, result, "\tcase map[string]int:\n\t\t// +tsgen generated from map[string]T\n")
+		assert.Contains(t, result, "\tcase map[string]io.Reader:\n\t\t// +tsgen generated from map[string]T\n")
+		assert.Contains(t, result, "\tcase []int:\n\t\t// +tsgen generated from []T\n\t\tswitch cb := cb.(type) {\n\t\tcase func(int, int):\n")
+		assert.Contains(t, result, "\tcase []*list.List:\n\t\t// +tsgen generated from []T\n\t\tswitch cb := cb.(type) {\n\t\tcase func(int, *list.List):\n")
+	}
+
+	// From the call in main
+	assert.Contains(t, analyzed, "\tcase map[string]bool:\n")
+	assert.NotContains(t, instantiated, "\tcase map[string]bool:\n")
+}
+
+func TestExpandInterfacePattern(t *testing.T) {
+	result := expandFile(t, "testdata/container.go", func(g *Gen) {
+		g.OnUnmatched = UnmatchedIgnore
+	})
+
+	assert.Contains(t, result, "\tcase *box:\n\t\t// +tsgen generated from interface { Get() T }\n\t\tvar x int = c.Get()\n")
+	assert.Contains(t, result, "\tcase name:\n\t\t// +tsgen generated from interface { Get() T }\n\t\tvar x string = c.Get()\n")
+
+	// Get has a pointer receiver
+	assert.NotContains(t, result, "case box:")
+
+	// Get has another signature
+	assert.NotContains(t, result, "case pair:")
+}
+
+func TestExpandSpecificity(t *testing.T) {
+	warnings := []error{}
+
+	result := expandFile(t, "testdata/specificity.go", func(g *Gen) {
+		g.Warn = func(err error) {
+			warnings = append(warnings, err)
+		}
+	})
+
+	assert.Contains(t, result, "\tcase []int:\n\t\t// +tsgen generated from []T\n\t\t_ = len(a)\n")
+	assert.Contains(t, result, "\tcase []chan<- bool:\n\t\t// +tsgen generated from []chan<- T\n\t\tvar x bool\n")
+	assert.Contains(t, result, "\tcase [2]string:\n\t\t// +tsgen generated from [2]T\n\t\t_ = a[1]\n")
+	assert.Contains(t, result, "\tcase [3]string:\n\t\t// +tsgen generated from [N]T\n\t\t_ = a[3-1]\n")
+
+	// Ambiguous; the first one is used
+	assert.Contains(t, result, "\tcase map[string]int:\n\t\t// +tsgen generated from map[string]T\n\t\tvar v int = a[\"\"]\n")
+	if assert.Len(t, warnings, 1) {
+		assert.IsType(t, &AmbiguousTemplateError{}, warnings[0])
+	}
+}
+
+func TestExpandIdempotent(t *testing.T) {
+	result := expandFile(t, "testdata/idempotent.go", nil)
+
+	assert.Equal(t, 1, strings.Count(result, "case map[string]int:"))
+	assert.Contains(t, result, "\tcase map[string]int:\n\t\t// hand-written\n")
+	assert.Contains(t, result, "\tcase map[string]bool:\n")
+	assert.Contains(t, result, "\tcase map[string][]byte:\n")
+
+	// Expanding the result again changes nothing
+	dir, err := ioutil.TempDir("", "tsgen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "idempotent.go")
+	err = ioutil.WriteFile(file, []byte(result), 0644)
+	require.NoError(t, err)
+
+	assert.Equal(t, result, expandFile(t, file, nil))
+}
+
+func TestExpandRegenerate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsgen")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src, err := ioutil.ReadFile("testdata/idempotent.go")
+	require.NoError(t, err)
+
+	file := filepath.Join(dir, "idempotent.go")
+
+	err = ioutil.WriteFile(file, src, 0644)
+	require.NoError(t, err)
+
+	result := expandFile(t, file, nil)
+
+	assert.Contains(t, result, "\tcase map[string]bool:\n\t\t// +tsgen generated from map[string]T\n")
+
+	// Remove a call site and expand again
+	result = strings.Replace(result, "\tkeys(map[string]bool{})\n", "", 1)
+	err = ioutil.WriteFile(file, []byte(result), 0644)
+	require.NoError(t, err)
+
+	result = expandFile(t, file, nil)
+
+	assert.NotContains(t, result, "case map[string]bool:")
+	assert.Contains(t, result, "\tcase map[string][]byte:\n\t\t// +tsgen generated from map[string]T\n")
+	assert.Equal(t, 1, strings.Count(result, "+tsgen generated"))
+}
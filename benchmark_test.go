@@ -0,0 +1,240 @@
+package gen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go/build"
+	"go/parser"
+	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/ssa"
+)
+
+// The benchmarks run on a synthetic program, in which a few packages call
+// the function with a template type switch and many others do not,
+// using some of the standard library:
+//
+//   go test -run NONE -bench . -benchmem
+//
+// The *All ones build the SSA of all the packages,
+// and the others build only the ones needed to expand (see buildSSA).
+const (
+	synthLibs  = 50 // packages not calling the template function
+	synthFuncs = 50 // functions in each of them
+	synthUsers = 3  // packages calling the template function
+)
+
+// synthStd is the standard library packages the synthetic program uses,
+// and their functions it refers to. The *All ones cannot build the SSA of
+// most of the standard library, e.g. the ones using range-over-func.
+var synthStd = map[string]string{
+	"bytes":   "bytes.NewBuffer",
+	"strconv": "strconv.Itoa",
+	"strings": "strings.Split",
+}
+
+const synthTemplate = `package tmpl
+
+type T interface{}
+
+func Keys(m interface{}) []string {
+	switch m := m.(type) {
+	case map[string]T:
+		ks := []string{}
+		for k := range m {
+			ks = append(ks, k)
+		}
+		return ks
+	}
+	return nil
+}
+`
+
+const synthLibFunc = `
+func Func%d(xs []int) int {
+	m := map[int]*item{}
+	sum := 0
+	for i, x := range xs {
+		if x%%2 == 0 {
+			m[i] = &item{key: "k", value: x}
+		} else {
+			sum += x
+		}
+	}
+	f := func(it *item) int { return it.value }
+	for _, it := range m {
+		sum += f(it)
+	}
+	return sum
+}
+`
+
+const synthUser = `package user%d
+
+import "synth/tmpl"
+
+type value struct{}
+
+func Run() {
+	tmpl.Keys(map[string]value{})
+}
+`
+
+// loadSynthProgram writes the synthetic program to a temporary GOPATH and loads it.
+func loadSynthProgram(b *testing.B) (*loader.Program, func()) {
+	dir, err := ioutil.TempDir("", "tsgen-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	write := func(path, src string) {
+		path = filepath.Join(dir, "src", "synth", path)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(src), 0644)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	write("tmpl/tmpl.go", synthTemplate)
+
+	imports := []string{}
+	calls := []string{}
+
+	for i := 0; i < synthLibs; i++ {
+		src := fmt.Sprintf("package lib%d\n\ntype item struct {\n\tkey   string\n\tvalue int\n}\n", i)
+		for j := 0; j < synthFuncs; j++ {
+			src += fmt.Sprintf(synthLibFunc, j)
+		}
+		write(fmt.Sprintf("lib%d/lib.go", i), src)
+
+		imports = append(imports, fmt.Sprintf("\t\"synth/lib%d\"", i))
+		calls = append(calls, fmt.Sprintf("\tlib%d.Func0(nil)", i))
+	}
+
+	for path, fn := range synthStd {
+		imports = append(imports, fmt.Sprintf("\t%q", path))
+		calls = append(calls, "\t_ = "+fn)
+	}
+
+	for i := 0; i < synthUsers; i++ {
+		write(fmt.Sprintf("user%d/user.go", i), fmt.Sprintf(synthUser, i))
+
+		imports = append(imports, fmt.Sprintf("\t\"synth/user%d\"", i))
+		calls = append(calls, fmt.Sprintf("\tuser%d.Run()", i))
+	}
+
+	write("cmd/main.go", "package main\n\nimport (\n"+strings.Join(imports, "\n")+"\n)\n\nfunc main() {\n"+strings.Join(calls, "\n")+"\n}\n")
+
+	// Find the packages in GOPATH, not by the go command in this module
+	b.Setenv("GO111MODULE", "off")
+
+	ctxt := build.Default
+	ctxt.GOPATH = dir
+
+	conf := loader.Config{
+		Build:      &ctxt,
+		ParserMode: parser.ParseComments,
+	}
+	conf.Import("synth/cmd")
+
+	prog, err := conf.Load()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return prog, func() { os.RemoveAll(dir) }
+}
+
+// synthGen returns a Gen on the synthetic program prog.
+func synthGen(prog *loader.Program) *Gen {
+	g := New()
+	g.Loader.Fset = prog.Fset
+	g.Mains = []string{"synth/cmd"}
+	g.program = prog
+	return g
+}
+
+func BenchmarkBuildSSA(b *testing.B) {
+	prog, cleanup := loadSynthProgram(b)
+	defer cleanup()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := synthGen(prog).buildSSA()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// createAllSSA creates the SSA packages for all the packages in prog,
+// in the same builder mode as buildSSA without Debug.
+func createAllSSA(prog *loader.Program) *ssa.Program {
+	ssaProg := ssa.NewProgram(prog.Fset, 0)
+	for _, pkg := range prog.AllPackages {
+		ssaProg.CreatePackage(pkg.Pkg, pkg.Files, &pkg.Info, pkg.Importable)
+	}
+	return ssaProg
+}
+
+func BenchmarkBuildSSAAll(b *testing.B) {
+	prog, cleanup := loadSynthProgram(b)
+	defer cleanup()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		createAllSSA(prog).Build()
+	}
+}
+
+func BenchmarkAnalyze(b *testing.B) {
+	prog, cleanup := loadSynthProgram(b)
+	defer cleanup()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		g := synthGen(prog)
+
+		err := g.buildSSA()
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_, err = g.analyze()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAnalyzeAll(b *testing.B) {
+	prog, cleanup := loadSynthProgram(b)
+	defer cleanup()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		g := synthGen(prog)
+		g.ssaProgram = createAllSSA(prog)
+		g.ssaProgram.Build()
+
+		_, err := g.analyze()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"golang.org/x/tools/go/loader"
+)
+
+// generatedMarker is the prefix of the comment at the head of the case clauses generated by "expand",
+// followed by the case expressions of the template.
+const generatedMarker = "+tsgen generated from "
+
+// cleanFileTypeSwitches is the main logic for "clean" mode.
+// It removes the case clauses generated by "expand" from the type switch statements in file.
+// The imports used only by the removed clauses are removed too.
+func (g *Gen) cleanFileTypeSwitches(pkg *loader.PackageInfo, file *ast.File) error {
+	imports := newImportManager(g.Loader.Fset, pkg, file)
+
+	removeGeneratedClauses(file)
+
+	imports.removeUnused()
+
+	return nil
+}
+
+// removeGeneratedClauses removes the case clauses marked as generated from file,
+// along with the comments inside them.
+func removeGeneratedClauses(file *ast.File) {
+	type span struct {
+		pos, end token.Pos
+	}
+
+	removed := []span{}
+
+	// The type switches whose first clauses are removed, mapped to the end of them
+	leadings := map[*ast.TypeSwitchStmt]token.Pos{}
+
+	forTypeSwitchStmt(file, func(sw *ast.TypeSwitchStmt, path []ast.Node) error {
+		list := []ast.Stmt{}
+		for i, st := range sw.Body.List {
+			end := sw.Body.Rbrace
+			if i+1 < len(sw.Body.List) {
+				end = sw.Body.List[i+1].Pos()
+			}
+
+			if isGeneratedClause(file, st.(*ast.CaseClause), end) {
+				removed = append(removed, span{st.Pos(), end})
+				if len(list) == 0 {
+					leadings[sw] = st.End()
+				}
+				continue
+			}
+
+			list = append(list, st)
+		}
+		sw.Body.List = list
+
+		return nil
+	})
+
+	comments := []*ast.CommentGroup{}
+	for _, cg := range file.Comments {
+		inRemoved := false
+		for _, s := range removed {
+			if s.pos <= cg.Pos() && cg.Pos() < s.end {
+				inRemoved = true
+				break
+			}
+		}
+
+		if !inRemoved {
+			comments = append(comments, cg)
+		}
+	}
+	file.Comments = comments
+
+	// Move the braces to the end of the removed clauses at the head,
+	// so that no empty lines are printed after them
+	for sw, leading := range leadings {
+		if !hasCommentBetween(file, sw.Body.Lbrace, leading) {
+			sw.Body.Lbrace = leading
+		}
+	}
+}
+
+// hasCommentBetween checks if file has comments between pos and end.
+func hasCommentBetween(file *ast.File, pos, end token.Pos) bool {
+	for _, cg := range file.Comments {
+		if pos < cg.Pos() && cg.Pos() < end {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isGeneratedClause checks if the clause, which ends before end, begins with the generated marker comment.
+func isGeneratedClause(file *ast.File, clause *ast.CaseClause, end token.Pos) bool {
+	if len(clause.Body) > 0 {
+		end = clause.Body[0].Pos()
+	}
+
+	for _, cg := range file.Comments {
+		if cg.Pos() < clause.Colon || cg.Pos() >= end {
+			continue
+		}
+
+		for _, c := range cg.List {
+			if strings.HasPrefix(commentText(c), generatedMarker) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// markGenerated records the marker comment of the clause generated from the template clause,
+// which is put at the head of the clause when the file is written (see placeMarkers).
+func (g *Gen) markGenerated(clause, template *ast.CaseClause) {
+	patterns := make([]string, len(template.List))
+	for i, expr := range template.List {
+		patterns[i] = strings.Join(strings.Fields(g.showNode(expr)), " ")
+	}
+
+	if g.markers == nil {
+		g.markers = map[*ast.CaseClause]*ast.CommentGroup{}
+	}
+
+	g.markers[clause] = &ast.CommentGroup{
+		List: []*ast.Comment{
+			{Text: "// " + generatedMarker + strings.Join(patterns, ", ")},
+		},
+	}
+}
+
+// placeMarkers returns a copy of file with the marker comments recorded by markGenerated
+// at the heads of the generated clauses, along with its file set.
+// The nodes of the generated clauses share one position, where the comments cannot be
+// placed in order, so the copy is made by printing file and parsing it again.
+func (g *Gen) placeMarkers(file *ast.File) (*token.FileSet, *ast.File, error) {
+	var buf bytes.Buffer
+	err := format.Node(&buf, g.Loader.Fset, file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fset := token.NewFileSet()
+	copied, err := parser.ParseFile(fset, g.tokenFile(file).Name(), buf.Bytes(), parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The clauses are in the same order in the both
+	clauses := caseClauses(file)
+	copiedClauses := caseClauses(copied)
+	if len(clauses) != len(copiedClauses) {
+		return nil, nil, fmt.Errorf("BUG: %s has %d case clauses after printed, not %d", g.tokenFile(file).Name(), len(copiedClauses), len(clauses))
+	}
+
+	for i, clause := range clauses {
+		marker := g.markers[clause]
+		if marker == nil {
+			continue
+		}
+
+		// At the start of the line next to the colon, so that the marker has its own line
+		// before the body
+		tokenFile := fset.File(copied.Pos())
+		line := tokenFile.Line(copiedClauses[i].Colon) + 1
+		if line > tokenFile.LineCount() {
+			return nil, nil, fmt.Errorf("BUG: no line after the case clause at %s", fset.Position(copiedClauses[i].Pos()))
+		}
+		marker.List[0].Slash = tokenFile.LineStart(line)
+		copied.Comments = append(copied.Comments, marker)
+	}
+
+	sort.Sort(byCommentPos(copied.Comments))
+
+	return fset, copied, nil
+}
+
+// caseClauses returns the case clauses of the switch statements in node.
+func caseClauses(node ast.Node) []*ast.CaseClause {
+	clauses := []*ast.CaseClause{}
+	ast.Inspect(node, func(node ast.Node) bool {
+		if clause, ok := node.(*ast.CaseClause); ok {
+			clauses = append(clauses, clause)
+		}
+		return true
+	})
+
+	return clauses
+}
+
+type byCommentPos []*ast.CommentGroup
+
+func (s byCommentPos) Len() int           { return len(s) }
+func (s byCommentPos) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCommentPos) Less(i, j int) bool { return s[i].Pos() < s[j].Pos() }
@@ -0,0 +1,44 @@
+package gen
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestClean(t *testing.T) {
+	var out bytes.Buffer
+	var err error
+
+	gen := New()
+	gen.FileWriter = func(path string) io.WriteCloser {
+		if sameFile(path, "testdata/clean.go") {
+			return nopCloser{&out}
+		}
+
+		return nil
+	}
+
+	gen.Loader.CreateFromFilenames("", "testdata/clean.go")
+
+	err = gen.Clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := out.String()
+	t.Log(result)
+
+	if !strings.Contains(result, "\tswitch m := m.(type) {\n\tcase map[string]int:\n\t\t// hand-written\n") {
+		t.Errorf("hand-written clause must be kept")
+	}
+
+	if strings.Contains(result, "map[string]bool") || strings.Contains(result, "generated") {
+		t.Errorf("generated clause must be removed")
+	}
+
+	if strings.Contains(result, "container/list") {
+		t.Errorf("import used only by generated clause must be removed")
+	}
+}
@@ -4,13 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"go/build"
-
 	"github.com/motemen/go-typeswitch-gen"
 )
 
@@ -35,16 +32,31 @@ func (nc noCloser) Close() error {
 	return nil
 }
 
-var usage = `Usage: %s [-w] [-main <pkg>] [-verbose] <mode> <file>
+var usage = `Usage: %s [-w] [-main <pattern>]... [-tests] [-analysis <algorithm>] [-instantiate-only] [-unmatched <policy>] [-verbose] [-debug] <mode> <file or pattern>...
 
 Modes:
   expand:   expand generic case clauses in type switch statements by its actual arguments
   sort:     sort case clauses in type switch statements
   scaffold: generate stub case clauses based on types that implement subject interface
+  clean:    remove case clauses generated by expand
+
+The files given, or all the files of the packages matching the patterns e.g. ./..., are rewritten.
 
 Flags:
 `
 
+// stringsFlag is a flag which can be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, usage, os.Args[0])
@@ -57,8 +69,16 @@ func main() {
 	var (
 		overwrite = flag.Bool("w", false, "write result to (source) file instead of stdout")
 		verbose   = flag.Bool("verbose", false, "log verbose")
-		main      = flag.String("main", "", "entrypoint package")
+		debug     = flag.Bool("debug", false, "enable sanity checks of SSA, for debugging tsgen")
+		tests     = flag.Bool("tests", false, "also start analysis from the tests of entrypoint packages")
+		instOnly  = flag.Bool("instantiate-only", false, "expand only with the types given by //tsgen:instantiate directives, without analysis")
+		unmatched gen.UnmatchedPolicy
+		analysis  gen.Analysis
+		mains     stringsFlag
 	)
+	flag.Var(&mains, "main", "entrypoint package or pattern e.g. ./cmd/..., can be given multiple times")
+	flag.Var(&analysis, "analysis", "algorithm to find argument types (pointer, cha, rta or vta)")
+	flag.Var(&unmatched, "unmatched", "how to handle argument types matching no templates (warn, fatal or ignore)")
 	flag.Parse()
 
 	args := flag.Args()
@@ -70,110 +90,133 @@ func main() {
 
 	mode := args[0]
 
-	target := args[1]
-	target, err = filepath.Abs(target)
+	g := gen.New()
+	g.Verbose = *verbose
+	g.Debug = *debug
+	g.OnUnmatched = unmatched
+	g.Warn = func(err error) {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+	}
+	g.Analysis = analysis
+	g.InstantiateOnly = *instOnly
+	g.Tests = *tests
+	g.Loader.AllowErrors = mode == "scaffold"
+
+	// Without entrypoints, the analysis starts from the targets or their tests
+	targetTests := mode == "expand" && (g.Tests || len(mains) == 0)
+
+	targets, err := importTargets(g, args[1:], targetTests)
 	dieIf(err)
 
-	if fi, err := os.Stat(target); err != nil || fi.IsDir() {
-		flag.Usage()
-		os.Exit(1)
+	if len(mains) > 0 {
+		pkgs, err := g.ResolvePackages(mains...)
+		dieIf(err)
+
+		for _, pkg := range pkgs {
+			importPackage(g, pkg.ImportPath, g.Tests)
+			g.Mains = append(g.Mains, pkg.ImportPath)
+		}
 	}
 
-	g := gen.New()
-	g.Verbose = *verbose
 	g.FileWriter = func(filename string) io.WriteCloser {
 		if filepath.IsAbs(filename) == false {
 			// TODO check errors
 			filename, _ = filepath.Abs(filename)
 		}
 
-		if filename != target {
+		if !targets[filename] {
 			return nil
 		}
 
 		if *overwrite {
-			w, err := os.Create(target)
+			w, err := os.Create(filename)
 			if err != nil {
 				panic(err)
 			}
 			return w
 		}
 
+		if len(targets) > 1 {
+			fmt.Printf("// %s\n", filename)
+		}
+
 		return noCloser{os.Stdout}
 	}
 
 	switch mode {
 	case "expand":
-		err := doExpand(g, target, *main)
-		dieIf(err)
+		err = g.Expand()
 
 	case "sort":
-		err := doSort(g, target)
-		dieIf(err)
+		err = g.Sort()
 
 	case "scaffold":
-		err := doScaffold(g, target)
-		dieIf(err)
-	}
-}
+		err = g.Scaffold()
 
-func doExpand(g *gen.Gen, target, main string) error {
-	if main == "" {
-		filenames, err := listSiblingFiles(target)
-		if err != nil {
-			return err
-		}
+	case "clean":
+		err = g.Clean()
 
-		g.Loader.CreateFromFilenames("", filenames...)
-	} else {
-		g.Loader.Import(main)
-		g.Main = main
+	default:
+		flag.Usage()
+		os.Exit(1)
 	}
-
-	return g.Expand()
+	dieIf(err)
 }
 
-func doSort(g *gen.Gen, target string) error {
-	filenames, err := listSiblingFiles(target)
-	if err != nil {
-		return err
-	}
-
-	g.Loader.CreateFromFilenames("", filenames...)
-
-	return g.Sort()
-}
+// importTargets adds the packages of the files or matching the patterns in args to g.Loader,
+// and returns the set of the files to rewrite.
+// The files given are rewritten by themselves, and all the files are for the patterns.
+func importTargets(g *gen.Gen, args []string, tests bool) (map[string]bool, error) {
+	targets := map[string]bool{}
+
+	fileDirs := []string{}
+	patterns := []string{}
+	for _, arg := range args {
+		if fi, err := os.Stat(arg); err == nil && !fi.IsDir() {
+			filename, err := filepath.Abs(arg)
+			if err != nil {
+				return nil, err
+			}
 
-func doScaffold(g *gen.Gen, target string) error {
-	filenames, err := listSiblingFiles(target)
-	if err != nil {
-		return err
+			targets[filename] = true
+			fileDirs = append(fileDirs, filepath.Dir(filename))
+		} else {
+			patterns = append(patterns, arg)
+		}
 	}
 
-	g.Loader.AllowErrors = true
-	g.Loader.CreateFromFilenames("", filenames...)
-
-	return g.Scaffold()
-}
+	if len(fileDirs) > 0 {
+		pkgs, err := g.ResolvePackages(fileDirs...)
+		if err != nil {
+			return nil, err
+		}
 
-func listSiblingFiles(filename string) ([]string, error) {
-	dir := filepath.Dir(filename)
-	entries, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return nil, err
+		for _, pkg := range pkgs {
+			importPackage(g, pkg.ImportPath, tests)
+		}
 	}
 
-	filenames := []string{}
-	for _, fi := range entries {
-		match, err := build.Default.MatchFile(dir, fi.Name())
+	if len(patterns) > 0 {
+		pkgs, err := g.ResolvePackages(patterns...)
 		if err != nil {
 			return nil, err
 		}
 
-		if match {
-			filenames = append(filenames, filepath.Join(dir, fi.Name()))
+		for _, pkg := range pkgs {
+			importPackage(g, pkg.ImportPath, tests)
+			for _, filename := range pkg.GoFiles {
+				targets[filename] = true
+			}
 		}
 	}
 
-	return filenames, nil
+	return targets, nil
+}
+
+func importPackage(g *gen.Gen, path string, tests bool) {
+	if tests {
+		g.Loader.ImportWithTests(path)
+	} else {
+		g.Loader.Import(path)
+	}
 }
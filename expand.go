@@ -1,141 +1,1014 @@
 package gen
 
 import (
-	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
 
 	"go/ast"
+	"go/token"
+	"go/types"
+	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/go/loader"
-	"golang.org/x/tools/go/types"
-
-	"github.com/motemen/go-astmanip"
+	"golang.org/x/tools/go/ssa"
 )
 
 // expandFileTypeSwitches is the main logic for "expand" mode.
 // May rewrite type switch statements in *ast.File file.
-func (g Gen) expandFileTypeSwitches(pkg *loader.PackageInfo, file *ast.File) error {
+func (g *Gen) expandFileTypeSwitches(pkg *loader.PackageInfo, file *ast.File) error {
 	// XXX We can also obtain *loader.PackageInfo by:
 	// pkg, _, _ := g.program.PathEnclosingInterval(file.Pos(), file.End())
-	for _, decl := range file.Decls {
-		funcDecl, ok := decl.(*ast.FuncDecl)
-		if !ok {
+
+	imports := newImportManager(g.Loader.Fset, pkg, file)
+
+	// The clauses generated previously are generated again
+	removeGeneratedClauses(file)
+
+	// Type switches nested in template clauses are expanded along with the outer ones
+	nested := map[*ast.TypeSwitchStmt]bool{}
+	forTypeSwitchStmt(file, func(sw *ast.TypeSwitchStmt, path []ast.Node) error {
+		typeSwitch := &typeSwitchStmt{
+			file:    file,
+			node:    sw,
+			info:    pkg.Info,
+			imports: imports,
+		}
+
+		if !typeSwitch.hasTemplates(g) {
+			return nil
+		}
+
+		// The ones in concrete clauses are expanded on their own
+		for _, t := range typeSwitch.templates(g) {
+			if !g.hasFreeTypeVariables(typeSwitch, t.typePattern, nil) {
+				continue
+			}
+
+			for _, n := range t.nested {
+				nested[n.node] = true
+			}
+		}
+
+		return nil
+	})
+
+	// For each type switch statements...
+	err := forTypeSwitchStmt(file, func(sw *ast.TypeSwitchStmt, path []ast.Node) error {
+		if nested[sw] {
+			return nil
+		}
+
+		g.log(file, sw, "type switch statement: %s", sw.Assign)
+
+		typeSwitch := &typeSwitchStmt{
+			file:    file,
+			node:    sw,
+			info:    pkg.Info,
+			imports: imports,
+		}
+
+		// Nothing to expand, and its package may not have SSA built
+		if !typeSwitch.hasTemplates(g) {
+			g.log(file, sw, "no template clauses")
+			return nil
+		}
+
+		subjectObj := typeSwitch.subjectObj()
+		fn := enclosingParamFunc(pkg, path, subjectObj)
+
+		var value ssa.Value
+		var indirect bool
+		if fn == nil && !g.InstantiateOnly {
+			var err error
+			value, indirect, err = g.subjectValue(pkg, path, typeSwitch)
+			if err != nil {
+				return err
+			}
+
+			// The subject may still be a parameter e.g. (x).(type)
+			if param, ok := value.(*ssa.Parameter); ok {
+				subjectObj = param.Object()
+				fn = enclosingParamFunc(pkg, path, subjectObj)
+			}
+		}
+
+		var tuples []argTuple
+		if fn != nil {
+			g.log(file, fn, "enclosing func: %s", funcType(fn))
+
+			subjects := typeSwitch.subjects(g)
+			subjects[0] = subjectObj
+
+			if !g.InstantiateOnly {
+				var err error
+				tuples, err = g.possibleArgTuples(pkg, fn, subjects)
+				if err != nil {
+					return err
+				}
+
+				for _, tuple := range tuples {
+					g.log(file, fn, "argument types: %s", tuple)
+				}
+			}
+
+			instantiated, err := g.funcInstantiations(pkg, fn, subjects)
+			if err != nil {
+				return err
+			}
+
+			for _, tuple := range instantiated {
+				g.log(file, fn, "argument types: %s (instantiated)", tuple)
+			}
+
+			tuples = append(tuples, instantiated...)
+		} else {
+			// The subject is a local variable, a function result and so on;
+			// ask the pointer analysis what it can be
+			if subjectObj == nil {
+				subject := typeSwitch.subject()
+				subjectObj = types.NewVar(subject.Pos(), pkg.Pkg, g.showNode(subject), pkg.Info.TypeOf(subject))
+			}
+
+			if !g.InstantiateOnly {
+				inTypes, err := g.possibleValueTypes(value, indirect)
+				if err != nil {
+					return err
+				}
+
+				for _, inType := range inTypes {
+					g.log(file, sw, "dynamic type: %s", inType)
+					tuples = append(tuples, argTuple{
+						args:     map[types.Object]types.Type{subjectObj: inType},
+						analysis: g.Analysis,
+					})
+				}
+			}
+		}
+
+		instantiated, err := g.switchInstantiations(pkg, file, sw, subjectObj)
+		if err != nil {
+			return err
+		}
+
+		for _, tuple := range instantiated {
+			g.log(file, sw, "argument types: %s (instantiated)", tuple)
+		}
+
+		tuples = append(tuples, instantiated...)
+
+		// Finally rewrite it
+		expanded, err := g.expand(typeSwitch, subjectObj, tuples)
+		if err != nil {
+			return err
+		}
+
+		*sw = *expanded
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	imports.removeUnused()
+
+	return nil
+}
+
+// typeSwitchStmt represents a parsed type switch statement.
+type typeSwitchStmt struct {
+	file *ast.File
+	node *ast.TypeSwitchStmt
+	info types.Info
+
+	// imports manages the imports of file for the generated code.
+	imports *importManager
+}
+
+// typeMatchResult is a type variable name to concrete type mapping
+type typeMatchResult map[string]types.Type
+
+func (stmt typeSwitchStmt) templates(gen *Gen) []template {
+	templates := []template{}
+
+	for _, clause := range stmt.node.Body.List {
+		clause := clause.(*ast.CaseClause) // must not fail
+
+		// Each pattern of a clause like `case map[string]T, map[int]T:`
+		// is a template sharing the body
+		nested := stmt.nestedTypeSwitches(clause)
+		underlying := stmt.hasDirective(gen, clause, "underlying")
+		anyDir := stmt.hasDirective(gen, clause, "anydir")
+		for i, expr := range clause.List {
+			tmpl := template{
+				typePattern: stmt.info.TypeOf(expr),
+				caseClause:  clause,
+				pattern:     i,
+				nested:      nested,
+				underlying:  underlying,
+				anyDir:      anyDir,
+			}
+			templates = append(templates, tmpl)
+		}
+	}
+
+	return templates
+}
+
+// hasDirective checks if clause has a comment "+tsgen <directive>"
+// between the case keyword and the colon, or following the colon on the same line.
+func (stmt typeSwitchStmt) hasDirective(gen *Gen, clause *ast.CaseClause, directive string) bool {
+	fset := gen.Loader.Fset
+	line := fset.Position(clause.Colon).Line
+
+	for _, cg := range stmt.file.Comments {
+		if cg.Pos() < clause.Case || cg.Pos() > clause.Colon && fset.Position(cg.Pos()).Line != line {
 			continue
 		}
 
-		if funcDecl.Body == nil {
-			// Maybe an object-provided function and we have no source information
+		for _, c := range cg.List {
+			if commentText(c) == "+tsgen "+directive {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// convertSubject converts the uses of the subject in clause, generated from the template tmpl,
+// to the type conv, except the ones being assigned to or addressed,
+// and the ones converted to interfaces, which keep the dynamic type of the subject (see interfaceUses).
+func (stmt typeSwitchStmt) convertSubject(clause, tmpl *ast.CaseClause, conv types.Type) {
+	obj := stmt.info.Implicits[tmpl]
+	if obj == nil || len(tmpl.List) != 1 {
+		return
+	}
+
+	// The uses are found in tmpl and then in clause, as the copied nodes keep the positions
+	excluded := map[token.Pos]bool{}
+	exclude := func(node ast.Node) {
+		ast.Inspect(node, func(node ast.Node) bool {
+			if ident, ok := node.(*ast.Ident); ok {
+				excluded[ident.Pos()] = true
+			}
+			return true
+		})
+	}
+
+	for pos := range stmt.interfaceUses(tmpl, obj) {
+		excluded[pos] = true
+	}
+
+	uses := map[token.Pos]bool{}
+	for _, st := range tmpl.Body {
+		ast.Inspect(st, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.AssignStmt:
+				for _, lhs := range node.Lhs {
+					exclude(lhs)
+				}
+			case *ast.IncDecStmt:
+				exclude(node.X)
+			case *ast.UnaryExpr:
+				if node.Op == token.AND {
+					exclude(node.X)
+				}
+			case *ast.Ident:
+				if stmt.info.Uses[node] == obj {
+					uses[node.Pos()] = true
+				}
+			}
+			return true
+		})
+	}
+
+	for _, st := range clause.Body {
+		replaceExprs(st, func(expr ast.Expr) ast.Expr {
+			ident, ok := expr.(*ast.Ident)
+			if !ok || !uses[ident.Pos()] || excluded[ident.Pos()] {
+				return nil
+			}
+
+			typeExpr, err := stmt.imports.typeExprAt(conv, ident.Pos())
+			if err != nil {
+				return nil
+			}
+
+			// Otherwise e.g. *T(x) would be *(T(x))
+			switch t := typeExpr.(type) {
+			case *ast.StarExpr, *ast.FuncType:
+				typeExpr = &ast.ParenExpr{Lparen: ident.Pos(), X: typeExpr, Rparen: ident.Pos()}
+			case *ast.ChanType:
+				if t.Dir == ast.RECV {
+					typeExpr = &ast.ParenExpr{Lparen: ident.Pos(), X: typeExpr, Rparen: ident.Pos()}
+				}
+			}
+
+			return &ast.CallExpr{Fun: typeExpr, Lparen: ident.Pos(), Args: []ast.Expr{ident}, Rparen: ident.End()}
+		})
+	}
+}
+
+// interfaceUses returns the positions of the uses of obj in the body of tmpl
+// which are implicitly converted to interfaces, e.g. passed as arguments of interface types,
+// returned as ones or compared with ones.
+func (stmt typeSwitchStmt) interfaceUses(tmpl *ast.CaseClause, obj types.Object) map[token.Pos]bool {
+	uses := map[token.Pos]bool{}
+
+	check := func(expr ast.Expr, t types.Type) {
+		ident, ok := ast.Unparen(expr).(*ast.Ident)
+		if ok && stmt.info.Uses[ident] == obj && t != nil && types.IsInterface(t) {
+			uses[ident.Pos()] = true
+		}
+	}
+
+	var visit func(node ast.Node, results *types.Tuple)
+	visit = func(node ast.Node, results *types.Tuple) {
+		ast.Inspect(node, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.FuncLit:
+				if sig, ok := stmt.info.TypeOf(node).(*types.Signature); ok {
+					visit(node.Body, sig.Results())
+				}
+				return false
+
+			case *ast.ReturnStmt:
+				if results != nil && len(node.Results) == results.Len() {
+					for i, r := range node.Results {
+						check(r, results.At(i).Type())
+					}
+				}
+
+			case *ast.CallExpr:
+				tv := stmt.info.Types[node.Fun]
+				if tv.IsType() {
+					for _, arg := range node.Args {
+						check(arg, tv.Type)
+					}
+					break
+				}
+
+				if tv.Type == nil {
+					break
+				}
+
+				sig, ok := tv.Type.Underlying().(*types.Signature)
+				if !ok {
+					break
+				}
+
+				params := sig.Params()
+				for i, arg := range node.Args {
+					switch {
+					case sig.Variadic() && i >= params.Len()-1 && !node.Ellipsis.IsValid():
+						check(arg, params.At(params.Len()-1).Type().(*types.Slice).Elem())
+					case i < params.Len():
+						check(arg, params.At(i).Type())
+					}
+				}
+
+			case *ast.AssignStmt:
+				if node.Tok == token.ASSIGN && len(node.Lhs) == len(node.Rhs) {
+					for i, lhs := range node.Lhs {
+						check(node.Rhs[i], stmt.info.TypeOf(lhs))
+					}
+				}
+
+			case *ast.ValueSpec:
+				if node.Type != nil {
+					for _, v := range node.Values {
+						check(v, stmt.info.TypeOf(node.Type))
+					}
+				}
+
+			case *ast.SendStmt:
+				if ch, ok := stmt.info.TypeOf(node.Chan).Underlying().(*types.Chan); ok {
+					check(node.Value, ch.Elem())
+				}
+
+			case *ast.BinaryExpr:
+				if node.Op == token.EQL || node.Op == token.NEQ {
+					check(node.X, stmt.info.TypeOf(node.Y))
+					check(node.Y, stmt.info.TypeOf(node.X))
+				}
+
+			case *ast.CompositeLit:
+				t := stmt.info.TypeOf(node)
+				if t == nil {
+					break
+				}
+
+				for i, elt := range node.Elts {
+					key, value := ast.Expr(nil), elt
+					if kv, ok := elt.(*ast.KeyValueExpr); ok {
+						key, value = kv.Key, kv.Value
+					}
+
+					switch t := t.Underlying().(type) {
+					case *types.Array:
+						check(value, t.Elem())
+					case *types.Slice:
+						check(value, t.Elem())
+					case *types.Map:
+						check(key, t.Key())
+						check(value, t.Elem())
+					case *types.Struct:
+						if ident, ok := key.(*ast.Ident); ok {
+							if field, ok := stmt.info.Uses[ident].(*types.Var); ok {
+								check(value, field.Type())
+							}
+						} else if key == nil && i < t.NumFields() {
+							check(value, t.Field(i).Type())
+						}
+					}
+				}
+			}
+
+			return true
+		})
+	}
+
+	for _, st := range tmpl.Body {
+		visit(st, stmt.enclosingResults(tmpl))
+	}
+
+	return uses
+}
+
+// enclosingResults returns the results of the function enclosing node in the file.
+func (stmt typeSwitchStmt) enclosingResults(node ast.Node) *types.Tuple {
+	path, _ := astutil.PathEnclosingInterval(stmt.file, node.Pos(), node.End())
+	for _, n := range path {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			if sig, ok := stmt.info.TypeOf(n).(*types.Signature); ok {
+				return sig.Results()
+			}
+			return nil
+		case *ast.FuncDecl:
+			if fn, ok := stmt.info.Defs[n.Name].(*types.Func); ok {
+				return fn.Type().(*types.Signature).Results()
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// rebindSubject rebinds the subject in clause, generated from the template tmpl with multiple patterns,
+// to the type of the switch expression if clause has only one type, e.g.
+//   case map[string]int:
+//   	{
+//   		m := interface{}(m)
+//   		...
+//   	}
+// as the subject has the type in the template but would have the type of the clause otherwise.
+func (stmt typeSwitchStmt) rebindSubject(clause, tmpl *ast.CaseClause) error {
+	obj := stmt.info.Implicits[tmpl]
+	if obj == nil || len(tmpl.List) == 1 || len(clause.List) != 1 {
+		return nil
+	}
+
+	used := false
+	for _, st := range tmpl.Body {
+		ast.Inspect(st, func(node ast.Node) bool {
+			if ident, ok := node.(*ast.Ident); ok && stmt.info.Uses[ident] == obj {
+				used = true
+			}
+			return !used
+		})
+	}
+	if !used {
+		return nil
+	}
+
+	pos := clause.Case
+	typeExpr, err := stmt.imports.typeExprAt(obj.Type(), pos)
+	if err != nil {
+		return err
+	}
+
+	rebind := &ast.AssignStmt{
+		Lhs:    []ast.Expr{&ast.Ident{NamePos: pos, Name: obj.Name()}},
+		TokPos: pos,
+		Tok:    token.DEFINE,
+		Rhs: []ast.Expr{
+			&ast.CallExpr{Fun: typeExpr, Lparen: pos, Args: []ast.Expr{&ast.Ident{NamePos: pos, Name: obj.Name()}}, Rparen: pos},
+		},
+	}
+
+	// In a block, as the subject cannot be redeclared in the scope of the clause
+	clause.Body = []ast.Stmt{
+		&ast.BlockStmt{Lbrace: pos, List: append([]ast.Stmt{rebind}, clause.Body...), Rbrace: pos},
+	}
+
+	return nil
+}
+
+// nestedTypeSwitches returns the type switch statements inside the clause body,
+// not including ones nested further in them or in function literals.
+func (stmt typeSwitchStmt) nestedTypeSwitches(clause *ast.CaseClause) []*typeSwitchStmt {
+	nested := []*typeSwitchStmt{}
+
+	for _, st := range clause.Body {
+		ast.Inspect(st, func(node ast.Node) bool {
+			switch node := node.(type) {
+			case *ast.FuncLit:
+				return false
+
+			case *ast.TypeSwitchStmt:
+				nested = append(nested, &typeSwitchStmt{
+					file:    stmt.file,
+					node:    node,
+					info:    stmt.info,
+					imports: stmt.imports,
+				})
+				return false
+			}
+
+			return true
+		})
+	}
+
+	return nested
+}
+
+// subjects returns the subject object of the type switch followed by
+// those of the type switches nested in its templates.
+func (stmt typeSwitchStmt) subjects(gen *Gen) []types.Object {
+	subjects := []types.Object{stmt.subjectObj()}
+	for _, t := range stmt.templates(gen) {
+		if t.pattern > 0 {
+			// Already visited by the first pattern of the clause
 			continue
 		}
 
-		// For each type switch statements...
-		for _, stmt := range funcDecl.Body.List {
-			sw, ok := stmt.(*ast.TypeSwitchStmt)
-			if !ok {
+		for _, nested := range t.nested {
+			subjects = append(subjects, nested.subjects(gen)...)
+		}
+	}
+
+	return subjects
+}
+
+// subjectObj returns the object the type switch subject refers to,
+// or nil if the subject is not a variable.
+func (stmt typeSwitchStmt) subjectObj() types.Object {
+	if ident, ok := stmt.subject().(*ast.Ident); ok {
+		return stmt.info.Uses[ident]
+	}
+
+	return nil
+}
+
+// findMatchingTemplate finds the most specific template matching to the input type in,
+// whose type variable bindings do not conflict with bound,
+// and returns the template and a typeMatchResult including bound.
+// If the template matched the underlying type of in, it is also returned
+// as the type the subject should be converted to.
+// Templates matching in itself are preferred to ones matching its underlying type.
+// If more than one templates are the most specific, the first one is used and a warning is printed.
+func (gen *Gen) findMatchingTemplate(stmt *typeSwitchStmt, in types.Type, bound typeMatchResult) (*template, typeMatchResult, types.Type) {
+	var (
+		best      []template
+		bestM     typeMatchResult
+		bestConv  types.Type
+		bestScore = -1
+	)
+
+	for _, t := range stmt.templates(gen) {
+		m := typeMatchResult{}
+		var conv types.Type
+		if !gen.typeMatches(stmt, t.typePattern, in, m, t.anyDir) || !m.merge(bound) {
+			named, ok := in.(*types.Named)
+			if !ok || !gen.matchesUnderlying(t) {
 				continue
 			}
 
-			g.log(file, sw, "type switch statement: %s", sw.Assign)
+			m = typeMatchResult{}
+			if !gen.typeMatches(stmt, t.typePattern, named.Underlying(), m, t.anyDir) || !m.merge(bound) {
+				continue
+			}
+
+			conv = named.Underlying()
+		}
+
+		score := gen.specificity(stmt, t.typePattern)
+		if conv == nil {
+			score += maxSpecificity
+		}
+
+		if score > bestScore {
+			best, bestM, bestConv, bestScore = []template{t}, m, conv, score
+		} else if score == bestScore {
+			best = append(best, t)
+		}
+	}
+
+	if len(best) == 0 {
+		return nil, nil, nil
+	}
+
+	if len(best) > 1 {
+		gen.ambiguous(stmt, in, best)
+	}
+
+	return &best[0], bestM, bestConv
+}
+
+// maxSpecificity is larger than the specificity of any pattern.
+const maxSpecificity = 1 << 16
+
+// specificity scores how specific the pattern pat in stmt is.
+// The score is the number of type constructors and concrete types in the pattern,
+// plus the number of the type variables occurring more than once or having constraints,
+// and of the arrays with constant lengths.
+// e.g. []chan<- T is more specific than []T, which is more specific than T.
+func (gen *Gen) specificity(stmt *typeSwitchStmt, pat types.Type) int {
+	score := 0
+	seen := map[string]bool{}
+
+	walkType(pat, func(t types.Type) bool {
+		switch t := t.(type) {
+		case *types.Named:
+			tv := gen.typeVariable(t)
+			if tv == nil {
+				score++
+				break
+			}
+
+			name := t.Obj().Name()
+			if isWildcard(name) {
+				break
+			}
+
+			if seen[name] {
+				score++
+			}
+			seen[name] = true
+
+			if tv.numeric || len(tv.implements) > 0 {
+				score++
+			}
 
-			typeSwitch := &typeSwitchStmt{
-				file: file,
-				node: sw,
-				info: pkg.Info,
+		case *types.Array:
+			score++
+			if gen.lengthVariable(stmt, t) == "" {
+				score++
 			}
 
-			g.log(file, funcDecl, "enclosing func: %s", funcDecl.Type)
+		case *types.Tuple:
+			// Counted as a part of the signature
+
+		default:
+			score++
+		}
+
+		return true
+	})
+
+	return score
+}
+
+// ambiguous warns that the argument type in matched the templates equally specific.
+func (gen *Gen) ambiguous(stmt *typeSwitchStmt, in types.Type, templates []template) {
+	fset := gen.Loader.Fset
 
-			inTypes, err := g.possibleSubjectTypes(pkg, funcDecl, typeSwitch)
+	err := &AmbiguousTemplateError{
+		Pos:  fset.Position(stmt.node.Pos()),
+		Type: in,
+	}
+
+	for _, t := range templates {
+		err.Templates = append(err.Templates, CaseTemplate{
+			Pos:     fset.Position(t.caseClause.List[t.pattern].Pos()),
+			Pattern: t.typePattern,
+		})
+	}
+
+	gen.warn(err)
+}
+
+// unexported reports that the argument type in refers to the unexported type obj of another package.
+func (gen *Gen) unexported(stmt *typeSwitchStmt, in types.Type, obj *types.TypeName) {
+	gen.warn(&UnexportedTypeError{
+		Pos:        gen.Loader.Fset.Position(stmt.node.Pos()),
+		Type:       in,
+		Unexported: obj,
+	})
+}
+
+// matchesUnderlying checks if the template t matches named types by their underlying types,
+// which is enabled by a comment "+tsgen underlying" in the case clause
+// or by type variables declared with "+tsgen typevar underlying" in the pattern.
+func (gen *Gen) matchesUnderlying(t template) bool {
+	if t.underlying {
+		return true
+	}
+
+	underlying := false
+	walkType(t.typePattern, func(t types.Type) bool {
+		if named, ok := t.(*types.Named); ok {
+			if tv := gen.typeVariable(named); tv != nil && tv.underlying {
+				underlying = true
+			}
+		}
+
+		return !underlying
+	})
+
+	return underlying
+}
+
+// merge adds the bindings in other to m.
+// Returns false if any of them conflicts with the one in m.
+func (m typeMatchResult) merge(other typeMatchResult) bool {
+	for name, t := range other {
+		if u, ok := m[name]; ok && !types.Identical(t, u) {
+			return false
+		}
+	}
+
+	for name, t := range other {
+		m[name] = t
+	}
+
+	return true
+}
+
+// expand generates a type switch statement with expanded clauses for the argument tuples,
+// in which the types of the subject are keyed by subjectObj.
+func (gen *Gen) expand(stmt *typeSwitchStmt, subjectObj types.Object, tuples []argTuple) (*ast.TypeSwitchStmt, error) {
+	return gen.expandBound(stmt, subjectObj, tuples, typeMatchResult{})
+}
+
+// expandBound is expand for type switches nested in a template clause,
+// whose type variables are already bound to bound by the enclosing ones.
+func (gen *Gen) expandBound(stmt *typeSwitchStmt, subjectObj types.Object, tuples []argTuple, bound typeMatchResult) (*ast.TypeSwitchStmt, error) {
+	node := copyNode(stmt.node).(*ast.TypeSwitchStmt)
+	err := gen.applyTypeMatchResult(stmt, node, bound)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the tuples by the type of the subject,
+	// so the nested type switches can be expanded with them at once
+	ins := []types.Type{}
+	groups := map[string][]argTuple{}
+	for _, tuple := range tuples {
+		if subjectObj == nil {
+			break
+		}
+
+		in := tuple.args[subjectObj]
+		if in == nil {
+			continue
+		}
+
+		if _, ok := groups[in.String()]; !ok {
+			ins = append(ins, in)
+		}
+		groups[in.String()] = append(groups[in.String()], tuple)
+	}
+
+	type merged struct {
+		template *ast.CaseClause
+		body     string
+	}
+
+	generated := []ast.Stmt{}
+	mergedClauses := map[merged]*ast.CaseClause{}
+
+	// The generated clauses are put at the position of the first clause
+	pos := stmt.node.Body.Rbrace
+	if len(stmt.node.Body.List) > 0 {
+		pos = stmt.node.Body.List[0].Pos()
+	}
+
+	for _, in := range ins {
+		// Already handled by a hand-written or previously generated clause
+		if stmt.hasCase(in) {
+			gen.log(stmt.file, stmt.node, "%s has a case clause", in)
+			continue
+		}
+
+		// Cannot be written in the file
+		if obj := stmt.imports.inaccessible(in); obj != nil {
+			gen.unexported(stmt, in, obj)
+			continue
+		}
+
+		t, m, conv := gen.findMatchingTemplate(stmt, in, bound)
+		if t == nil {
+			err := gen.unmatched(stmt, in, groups[in.String()])
 			if err != nil {
-				return err
+				return nil, err
+			}
+
+			continue
+		}
+
+		if !gen.hasFreeTypeVariables(stmt, t.typePattern, bound) {
+			// The template has no type variables of its own,
+			// which are already filled in node
+			continue
+		}
+
+		gen.log(stmt.file, stmt.node, "%s matched to %s -> %s (found by %s)", in, t.typePattern, m, origins(groups[in.String()]))
+
+		clause, err := gen.apply(stmt, t, in, m)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, nested := range t.nested {
+			expanded, err := gen.expandBound(nested, nested.subjectObj(), groups[in.String()], m)
+			if err != nil {
+				return nil, err
+			}
+
+			replaceTypeSwitchStmt(clause, nested.node.Pos(), expanded)
+		}
+
+		if conv != nil {
+			stmt.convertSubject(clause, t.caseClause, conv)
+		}
+
+		// Otherwise the comments in the template would be printed in the generated clause,
+		// whose nodes have the same positions
+		setPos(clause, pos)
+
+		// In a clause with multiple patterns the subject has the type of the switch expression,
+		// so the bodies generated from one are merged into a clause with multiple types if they are identical
+		// i.e. they do not depend on the type variables.
+		// Otherwise each gets its own clause, where the subject is rebound to the type of the switch expression
+		// if the clause has only one type (see rebindSubject).
+		if len(t.caseClause.List) > 1 {
+			key := merged{t.caseClause, gen.showNode(&ast.BlockStmt{List: clause.Body})}
+			if cc, ok := mergedClauses[key]; ok {
+				cc.List = append(cc.List, clause.List...)
+				continue
 			}
 
-			for _, inType := range inTypes {
-				// g.log(file, funcDecl, "argument type: %s (from %s)", inType, in[0].Caller.Func)
-				g.log(file, funcDecl, "argument type: %s", inType)
-			}
+			mergedClauses[key] = clause
+		}
+
+		gen.markGenerated(clause, t.caseClause)
+
+		generated = append([]ast.Stmt{clause}, generated...)
+	}
+
+	// The clauses with one type left, in which the subject would not have the type of the switch expression
+	for key, clause := range mergedClauses {
+		err := stmt.rebindSubject(clause, key.template)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	node.Body.List = append(generated, node.Body.List...)
+
+	return node, nil
+}
 
-			// Finally rewrite it
-			*sw = *g.expand(typeSwitch, inTypes)
+// origins returns how the types in tuples are found, e.g. "pointer, directive".
+func origins(tuples []argTuple) string {
+	seen := map[string]bool{}
+	ss := []string{}
+	for _, tuple := range tuples {
+		if o := tuple.origin(); !seen[o] {
+			seen[o] = true
+			ss = append(ss, o)
 		}
 	}
 
-	return nil
+	return strings.Join(ss, ", ")
 }
 
-// typeSwitchStmt represents a parsed type switch statement.
-type typeSwitchStmt struct {
-	file *ast.File
-	node *ast.TypeSwitchStmt
-	info types.Info
-}
+// unmatched reports that the argument type in from tuples matched no templates of stmt,
+// according to gen.OnUnmatched.
+func (gen *Gen) unmatched(stmt *typeSwitchStmt, in types.Type, tuples []argTuple) error {
+	if stmt.coveredAtRuntime(gen, in) {
+		gen.log(stmt.file, stmt.node, "%s is handled by the default or an interface case", in)
+		return nil
+	}
 
-// typeMatchResult is a type variable name to concrete type mapping
-type typeMatchResult map[string]types.Type
+	if gen.OnUnmatched == UnmatchedIgnore {
+		gen.log(stmt.file, stmt.node, "no template matched for %s", in)
+		return nil
+	}
 
-func (stmt typeSwitchStmt) templates() []template {
-	templates := []template{}
+	fset := gen.Loader.Fset
 
-	for _, clause := range stmt.node.Body.List {
-		clause := clause.(*ast.CaseClause) // must not fail
+	err := &UnmatchedTypeError{
+		Pos:  fset.Position(stmt.node.Pos()),
+		Type: in,
+	}
 
-		if len(clause.List) != 1 { // XXX should/can we support multiple patterns?
-			continue
+	for _, tuple := range tuples {
+		if tuple.site != nil {
+			err.Sites = append(err.Sites, fset.Position(tuple.site.Pos()))
 		}
+		if tuple.directive.IsValid() {
+			err.Directives = append(err.Directives, fset.Position(tuple.directive))
+		}
+	}
 
-		tmpl := template{
-			typePattern: stmt.info.TypeOf(clause.List[0]),
-			caseClause:  clause,
+	for _, t := range stmt.templates(gen) {
+		if !gen.hasFreeTypeVariables(stmt, t.typePattern, nil) {
+			continue
 		}
-		templates = append(templates, tmpl)
+
+		err.Templates = append(err.Templates, CaseTemplate{
+			Pos:     fset.Position(t.caseClause.List[t.pattern].Pos()),
+			Pattern: t.typePattern,
+		})
 	}
 
-	return templates
+	if gen.OnUnmatched == UnmatchedFatal {
+		return err
+	}
+
+	gen.warn(err)
+
+	return nil
 }
 
-// findMatchingTemplate finds the first matching template to the input type in and returns the template and a typeMatchResult.
-func (gen Gen) findMatchingTemplate(stmt *typeSwitchStmt, in types.Type) (*template, typeMatchResult) {
-	for _, t := range stmt.templates() {
-		m := typeMatchResult{}
-		if gen.typeMatches(stmt, t.typePattern, in, m) {
-			return &t, m
+// hasTemplates checks if stmt has template clauses, whose patterns have type variables.
+func (stmt typeSwitchStmt) hasTemplates(gen *Gen) bool {
+	for _, clause := range stmt.node.Body.List {
+		for _, expr := range clause.(*ast.CaseClause).List {
+			if t := stmt.info.TypeOf(expr); t != nil && gen.hasFreeTypeVariables(&stmt, t, nil) {
+				return true
+			}
 		}
 	}
 
-	return nil, nil
+	return false
 }
 
-// expand generates a type switch statement with expanded clauses for input types ins.
-func (gen Gen) expand(stmt *typeSwitchStmt, ins []types.Type) *ast.TypeSwitchStmt {
-	node := astmanip.CopyNode(stmt.node).(*ast.TypeSwitchStmt)
-	seen := map[string]bool{}
-	for _, in := range ins {
-		if seen[in.String()] {
-			continue
+// coveredAtRuntime checks if in is handled at runtime by the default clause or
+// one of the interface type cases which are not type variables.
+func (stmt typeSwitchStmt) coveredAtRuntime(gen *Gen, in types.Type) bool {
+	for _, clause := range stmt.node.Body.List {
+		if clause.(*ast.CaseClause).List == nil {
+			return true
 		}
+	}
 
-		t, m := gen.findMatchingTemplate(stmt, in)
+	for t := range stmt.caseTypes() {
 		if t == nil {
-			// TODO error reporting
+			continue
 		}
 
-		gen.log(stmt.file, stmt.node, "%s matched to %s -> %s", in, t.typePattern, m)
+		if named, ok := t.(*types.Named); ok && gen.isTypeVariable(named) {
+			continue
+		}
+
+		if it, ok := t.Underlying().(*types.Interface); ok && types.Implements(in, it) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replaceTypeSwitchStmt replaces the type switch statement at pos inside node with sw.
+func replaceTypeSwitchStmt(node ast.Node, pos token.Pos, sw *ast.TypeSwitchStmt) {
+	ast.Inspect(node, func(node ast.Node) bool {
+		if node, ok := node.(*ast.TypeSwitchStmt); ok && node.Pos() == pos {
+			*node = *sw
+			return false
+		}
 
-		clause := t.apply(m)
-		node.Body.List = append(
-			[]ast.Stmt{clause},
-			node.Body.List...,
-		)
+		return true
+	})
+}
 
-		seen[in.String()] = true
+// subject returns the expression of interest of type-switch,
+// which is x of either `switch y := x.(type)` or `switch x.(type)`.
+func (stmt typeSwitchStmt) subject() ast.Expr {
+	var expr ast.Expr
+	switch assign := stmt.node.Assign.(type) {
+	case *ast.AssignStmt:
+		expr = assign.Rhs[0]
+	case *ast.ExprStmt:
+		expr = assign.X
 	}
 
-	return node
+	return unparen(unparen(expr).(*ast.TypeAssertExpr).X)
 }
 
-// subject returns the variable ast.Ident of interest of type-switch.
-// TODO: support other forms than `switch y := x.(type)`, otherwise panics
-func (stmt typeSwitchStmt) subject() *ast.Ident {
-	return stmt.node.Assign.(*ast.AssignStmt).Rhs[0].(*ast.TypeAssertExpr).X.(*ast.Ident)
+func unparen(expr ast.Expr) ast.Expr {
+	for {
+		paren, ok := expr.(*ast.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = paren.X
+	}
 }
 
 // caseTypes returns the map to clauses from their type cases.
@@ -157,6 +1030,17 @@ func (stmt typeSwitchStmt) caseTypes() map[types.Type]*ast.CaseClause {
 	return cases
 }
 
+// hasCase checks if stmt has a case clause of the type in.
+func (stmt typeSwitchStmt) hasCase(in types.Type) bool {
+	for t := range stmt.caseTypes() {
+		if t != nil && types.Identical(t, in) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // template represents a clause template.
 type template struct {
 	// typePattern is a type wich type variables e.g. map[string]T, func(T) (S, error).
@@ -164,10 +1048,28 @@ type template struct {
 
 	// caseClause is a clause template with type variables.
 	caseClause *ast.CaseClause
+
+	// pattern is the index of typePattern in the case list of caseClause.
+	pattern int
+
+	// nested is the type switches inside caseClause,
+	// whose templates are expanded along with this one.
+	nested []*typeSwitchStmt
+
+	// underlying is true if the template matches named types by their underlying types.
+	underlying bool
+
+	// anyDir is true if the channel patterns in the template match channels of any direction,
+	// which is enabled by a comment "+tsgen anydir" in the case clause.
+	anyDir bool
 }
 
-// typeMatches is a helper function for FindMatchingTemplate
-func (gen Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatchResult) bool {
+// typeMatches is a helper function for FindMatchingTemplate.
+// Channel patterns match channels of any direction if anyDir is true.
+func (gen *Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatchResult, anyDir bool) bool {
+	// Aliases e.g. any are matched by the types they denote
+	pat, in = types.Unalias(pat), types.Unalias(in)
+
 	switch pat := pat.(type) {
 	case *types.Array:
 		in, ok := in.(*types.Array)
@@ -175,7 +1077,19 @@ func (gen Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatch
 			return false
 		}
 
-		return gen.typeMatches(stmt, pat.Elem(), in.Elem(), m)
+		if name := gen.lengthVariable(stmt, pat); name != "" {
+			if bound, ok := m[name]; ok {
+				if bound != arrayLength(in.Len()) {
+					return false
+				}
+			} else if !isWildcard(name) {
+				m[name] = arrayLength(in.Len())
+			}
+		} else if pat.Len() != in.Len() {
+			return false
+		}
+
+		return gen.typeMatches(stmt, pat.Elem(), in.Elem(), m, anyDir)
 
 	case *types.Basic:
 		return types.Identical(pat, in)
@@ -186,20 +1100,42 @@ func (gen Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatch
 			return false
 		}
 
-		if pat.Dir() != in.Dir() {
+		// Directional channel patterns also match bidirectional channels,
+		// which can be used in the same way
+		if pat.Dir() != in.Dir() && in.Dir() != types.SendRecv && !anyDir {
 			return false
 		}
 
-		return gen.typeMatches(stmt, pat.Elem(), in.Elem(), m)
+		return gen.typeMatches(stmt, pat.Elem(), in.Elem(), m, anyDir)
 
 	case *types.Interface:
-		in, ok := in.(*types.Interface)
-		if !ok {
-			return false
+		if !gen.hasFreeTypeVariables(stmt, pat, typeMatchResult{}) {
+			in, ok := in.(*types.Interface)
+			if !ok {
+				return false
+			}
+
+			// XXX is it OK?
+			return types.Identical(pat, in)
 		}
 
-		// XXX is it OK?
-		return types.Identical(pat, in)
+		// Interface patterns with type variables e.g. interface{ Get() T }
+		// match the types having the methods in their method sets
+		mset := types.NewMethodSet(in)
+		for i := 0; i < pat.NumMethods(); i++ {
+			method := pat.Method(i)
+
+			sel := mset.Lookup(method.Pkg(), method.Name())
+			if sel == nil {
+				return false
+			}
+
+			if !gen.typeMatches(stmt, method.Type(), sel.Type(), m, anyDir) {
+				return false
+			}
+		}
+
+		return true
 
 	case *types.Map:
 		in, ok := in.(*types.Map)
@@ -207,18 +1143,32 @@ func (gen Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatch
 			return false
 		}
 
-		if !gen.typeMatches(stmt, pat.Key(), in.Key(), m) {
+		if !gen.typeMatches(stmt, pat.Key(), in.Key(), m, anyDir) {
 			return false
 		}
-		if !gen.typeMatches(stmt, pat.Elem(), in.Elem(), m) {
+		if !gen.typeMatches(stmt, pat.Elem(), in.Elem(), m, anyDir) {
 			return false
 		}
 
 		return true
 
 	case *types.Named:
-		if gen.isTypeVariable(pat) {
-			m[pat.Obj().Name()] = in
+		if tv := gen.typeVariable(pat); tv != nil {
+			if !tv.accepts(in) {
+				return false
+			}
+
+			name := pat.Obj().Name()
+			if isWildcard(name) {
+				return true
+			}
+
+			// Every occurrence of the type variable must be bound to the same type
+			if bound, ok := m[name]; ok {
+				return types.Identical(bound, in)
+			}
+
+			m[name] = in
 			return true
 		}
 
@@ -230,7 +1180,7 @@ func (gen Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatch
 			return false
 		}
 
-		return gen.typeMatches(stmt, pat.Elem(), in.Elem(), m)
+		return gen.typeMatches(stmt, pat.Elem(), in.Elem(), m, anyDir)
 
 	case *types.Signature:
 		in, ok := in.(*types.Signature)
@@ -238,11 +1188,15 @@ func (gen Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatch
 			return false
 		}
 
-		if !gen.typeMatches(stmt, pat.Params(), in.Params(), m) {
+		if pat.Variadic() != in.Variadic() {
+			return false
+		}
+
+		if !gen.typeMatches(stmt, pat.Params(), in.Params(), m, anyDir) {
 			return false
 		}
 
-		if !gen.typeMatches(stmt, pat.Results(), in.Results(), m) {
+		if !gen.typeMatches(stmt, pat.Results(), in.Results(), m, anyDir) {
 			return false
 		}
 
@@ -254,7 +1208,7 @@ func (gen Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatch
 			return false
 		}
 
-		return gen.typeMatches(stmt, pat.Elem(), in.Elem(), m)
+		return gen.typeMatches(stmt, pat.Elem(), in.Elem(), m, anyDir)
 
 	case *types.Struct:
 		in, ok := in.(*types.Struct)
@@ -267,7 +1221,12 @@ func (gen Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatch
 		}
 
 		for i := 0; i < pat.NumFields(); i++ {
-			if !gen.typeMatches(stmt, pat.Field(i).Type(), in.Field(i).Type(), m) {
+			p, f := pat.Field(i), in.Field(i)
+			if p.Id() != f.Id() || p.Anonymous() != f.Anonymous() || pat.Tag(i) != in.Tag(i) {
+				return false
+			}
+
+			if !gen.typeMatches(stmt, p.Type(), f.Type(), m, anyDir) {
 				return false
 			}
 		}
@@ -285,7 +1244,7 @@ func (gen Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatch
 		}
 
 		for i := 0; i < pat.Len(); i++ {
-			if !gen.typeMatches(stmt, pat.At(i).Type(), in.At(i).Type(), m) {
+			if !gen.typeMatches(stmt, pat.At(i).Type(), in.At(i).Type(), m, anyDir) {
 				return false
 			}
 		}
@@ -293,39 +1252,130 @@ func (gen Gen) typeMatches(stmt *typeSwitchStmt, pat, in types.Type, m typeMatch
 		return true
 
 	default:
-		fmt.Printf("TODO: %#v\n", pat)
 		return false
 	}
 }
 
-// apply applies typeMatchResult m to the template's caseClause and fills the type variables to specific types.
-func (t *template) apply(m typeMatchResult) *ast.CaseClause {
-	newClause := astmanip.CopyNode(t.caseClause).(*ast.CaseClause)
-	ast.Inspect(newClause, func(node ast.Node) bool {
-		if ident, ok := node.(*ast.Ident); ok {
-			if r, ok := m[ident.Name]; ok {
-				// TODO insert import; Here must be enhanced
-				name, _ := splitType(r)
-				ident.Name = name
+// apply generates a clause for the type in from the template t of stmt,
+// whose type variables are bound as m.
+func (gen *Gen) apply(stmt *typeSwitchStmt, t *template, in types.Type, m typeMatchResult) (*ast.CaseClause, error) {
+	newClause := copyNode(t.caseClause).(*ast.CaseClause)
+
+	err := gen.applyTypeMatchResult(stmt, newClause, m)
+	if err != nil {
+		return nil, err
+	}
+
+	// The pattern may have wildcards not in m
+	expr, err := stmt.imports.typeExpr(in)
+	if err != nil {
+		return nil, err
+	}
+	newClause.List = []ast.Expr{expr}
+
+	return newClause, nil
+}
+
+// applyTypeMatchResult fills the type variables in node, a copy of a part of stmt, to specific types in place.
+// Only the identifiers referring to the type variables (or length variables) are replaced,
+// with the expressions of the types bound in m.
+func (gen *Gen) applyTypeMatchResult(stmt *typeSwitchStmt, node ast.Node, m typeMatchResult) error {
+	// The identifiers are looked up by their positions, as node is a copy
+	vars := map[token.Pos]types.Type{}
+	for ident, obj := range stmt.info.Uses {
+		if ident.Pos() < node.Pos() || node.End() <= ident.Pos() {
+			continue
+		}
+
+		r, ok := m[obj.Name()]
+		if !ok {
+			continue
+		}
+
+		switch obj := obj.(type) {
+		case *types.TypeName:
+			if named, ok := obj.Type().(*types.Named); ok && gen.isTypeVariable(named) {
+				vars[ident.Pos()] = r
+			}
+		case *types.Const:
+			if _, _, _, _, ok := gen.typeVariableDecl(obj); ok {
+				vars[ident.Pos()] = r
 			}
 		}
-		return true
+	}
+
+	var err error
+	replaceExprs(node, func(expr ast.Expr) ast.Expr {
+		var ident *ast.Ident
+		switch expr := expr.(type) {
+		case *ast.Ident:
+			ident = expr
+		case *ast.SelectorExpr:
+			// Qualified e.g. pkg.T
+			ident = expr.Sel
+		default:
+			return nil
+		}
+
+		r, ok := vars[ident.Pos()]
+		if !ok {
+			return nil
+		}
+
+		typeExpr, e := stmt.imports.typeExprAt(r, expr.Pos())
+		if e != nil {
+			err = e
+			return nil
+		}
+
+		return typeExpr
 	})
 
-	return newClause
+	return err
 }
 
-// splitType splits types.Type t to short form and its belonging package.
-// e.g. type github.com/motemen/gen.Gen -> ("gen.Gen", "github.com/motemen/gen")
-func splitType(t types.Type) (string, string) {
-	if named, ok := t.(*types.Named); ok {
-		obj := named.Obj()
-		return obj.Pkg().Name() + "." + obj.Name(), obj.Pkg().Path()
-	} else if pt, ok := t.(*types.Pointer); ok {
-		name, pkg := splitType(pt.Elem())
-		return "*" + name, pkg
-	} else {
-		return t.String(), ""
+// replaceExprs replaces the expressions in node with the ones fn returns.
+// fn returns nil not to replace the expression, and then its children are visited.
+// The expressions in fields of specific types e.g. *ast.Ident are not replaced.
+func replaceExprs(node ast.Node, fn func(ast.Expr) ast.Expr) {
+	replaceExprsValue(reflect.ValueOf(node), fn)
+}
+
+var (
+	nodeType = reflect.TypeOf((*ast.Node)(nil)).Elem()
+	exprType = reflect.TypeOf((*ast.Expr)(nil)).Elem()
+)
+
+func replaceExprsValue(v reflect.Value, fn func(ast.Expr) ast.Expr) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+
+		if expr, ok := v.Interface().(ast.Expr); ok && v.CanSet() {
+			if r := fn(expr); r != nil && reflect.TypeOf(r).AssignableTo(v.Type()) {
+				v.Set(reflect.ValueOf(r))
+				return
+			}
+		}
+
+		replaceExprsValue(v.Elem(), fn)
+
+	case reflect.Ptr:
+		if v.IsNil() || !v.Type().Implements(nodeType) {
+			return
+		}
+
+		st := v.Elem()
+		for i := 0; i < st.NumField(); i++ {
+			replaceExprsValue(st.Field(i), fn)
+		}
+
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			replaceExprsValue(v.Index(i), fn)
+		}
 	}
 }
 
@@ -334,60 +1384,338 @@ func splitType(t types.Type) (string, string) {
 // - is an interface{} with name consisted of all uppercase letters
 // - or a type declared with a comment of "// +tsgen typevar"
 func (gen *Gen) isTypeVariable(t *types.Named) bool {
+	return gen.typeVariable(t) != nil
+}
+
+// isWildcard checks if a type variable named name is a wildcard, e.g. _T,
+// which matches any type without being bound.
+func isWildcard(name string) bool {
+	return strings.HasPrefix(name, "_")
+}
+
+// hasFreeTypeVariables checks if the type t in the patterns of stmt has type variables
+// (or length variables) which are wildcards or are not bound in bound.
+func (gen *Gen) hasFreeTypeVariables(stmt *typeSwitchStmt, t types.Type, bound typeMatchResult) bool {
+	free := false
+
+	walkType(t, func(t types.Type) bool {
+		var name string
+		switch t := t.(type) {
+		case *types.Named:
+			if gen.isTypeVariable(t) {
+				name = t.Obj().Name()
+			}
+		case *types.Array:
+			name = gen.lengthVariable(stmt, t)
+		}
+
+		if name != "" {
+			if _, ok := bound[name]; isWildcard(name) || !ok {
+				free = true
+			}
+		}
+
+		return !free
+	})
+
+	return free
+}
+
+// walkType calls fn for t and the types composing it, not including the underlying types of named ones.
+// The types composing t are skipped if fn returns false.
+func walkType(t types.Type, fn func(types.Type) bool) {
+	t = types.Unalias(t)
+	if !fn(t) {
+		return
+	}
+
+	switch t := t.(type) {
+	case *types.Array:
+		walkType(t.Elem(), fn)
+
+	case *types.Chan:
+		walkType(t.Elem(), fn)
+
+	case *types.Interface:
+		for i := 0; i < t.NumMethods(); i++ {
+			walkType(t.Method(i).Type(), fn)
+		}
+
+	case *types.Map:
+		walkType(t.Key(), fn)
+		walkType(t.Elem(), fn)
+
+	case *types.Pointer:
+		walkType(t.Elem(), fn)
+
+	case *types.Signature:
+		walkType(t.Params(), fn)
+		walkType(t.Results(), fn)
+
+	case *types.Slice:
+		walkType(t.Elem(), fn)
+
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			walkType(t.Field(i).Type(), fn)
+		}
+
+	case *types.Tuple:
+		for i := 0; i < t.Len(); i++ {
+			walkType(t.At(i).Type(), fn)
+		}
+	}
+}
+
+// typeVar is a type variable with the constraints on the types bound to it.
+type typeVar struct {
+	// numeric requires the types to be numeric.
+	numeric bool
+
+	// implements is the interfaces the types must implement,
+	// including the underlying interface of the type variable itself.
+	implements []*types.Interface
+
+	// underlying is true if the templates with the type variable
+	// match named types by their underlying types.
+	underlying bool
+
+	// invalid is the constraints which are unknown or whose interfaces could not be resolved.
+	// The type variable accepts no types with them, rather than any types.
+	invalid []string
+}
+
+// accepts checks if t satisfies the constraints of the type variable.
+func (tv *typeVar) accepts(t types.Type) bool {
+	if len(tv.invalid) > 0 {
+		return false
+	}
+
+	if tv.numeric {
+		basic, ok := t.Underlying().(*types.Basic)
+		if !ok || basic.Info()&types.IsNumeric == 0 {
+			return false
+		}
+	}
+
+	for _, it := range tv.implements {
+		if !types.Implements(t, it) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// typeVariable returns the type variable t, or nil if t is not a type variable (see isTypeVariable).
+// Type variables declared with the comment may have constraints after "typevar":
+//   // +tsgen typevar numeric
+//   // +tsgen typevar implements=fmt.Stringer
+// and the ones which are non-empty interfaces require the types to implement them.
+func (gen *Gen) typeVariable(t *types.Named) *typeVar {
+	obj := t.Obj()
+
+	var tv *typeVar
+
 	if it, ok := t.Underlying().(*types.Interface); ok && it.Empty() {
-		name := t.Obj().Name()
+		name := obj.Name()
 		if name == strings.ToUpper(name) {
-			return true
+			tv = &typeVar{}
+		}
+	}
+
+	if pkg, file, spec, args, ok := gen.typeVariableDecl(obj); ok {
+		tv = &typeVar{}
+		for _, arg := range args {
+			switch {
+			case arg == "numeric":
+				tv.numeric = true
+
+			case arg == "underlying":
+				tv.underlying = true
+
+			case strings.HasPrefix(arg, "implements="):
+				name := strings.TrimPrefix(arg, "implements=")
+				if it := gen.lookupInterface(pkg, file, name); it != nil {
+					tv.implements = append(tv.implements, it)
+				} else {
+					gen.log(file, spec, "could not resolve interface %s", name)
+					tv.invalid = append(tv.invalid, arg)
+				}
+
+			default:
+				gen.log(file, spec, "unknown type variable constraint: %s", arg)
+				tv.invalid = append(tv.invalid, arg)
+			}
 		}
 	}
 
-	genDecls := []*ast.GenDecl{}
+	if tv == nil {
+		return nil
+	}
+
+	if it, ok := t.Underlying().(*types.Interface); ok && !it.Empty() {
+		tv.implements = append(tv.implements, it)
+	}
+
+	return tv
+}
+
+// typeVariableDecl finds the declaration of obj with the comment "+tsgen typevar",
+// and returns the spec declaring it along with the arguments in the comment.
+func (gen *Gen) typeVariableDecl(obj types.Object) (*loader.PackageInfo, *ast.File, ast.Spec, []string, bool) {
+	pkg, path, _ := gen.program.PathEnclosingInterval(obj.Pos(), obj.Pos())
+
+	var (
+		file    *ast.File
+		genDecl *ast.GenDecl
+		spec    ast.Spec
+		docs    []*ast.CommentGroup
+	)
+	for _, node := range path {
+		switch node := node.(type) {
+		case *ast.File:
+			file = node
+
+		case *ast.GenDecl:
+			genDecl = node
+
+		case *ast.TypeSpec:
+			if pkg.Defs[node.Name] == obj {
+				spec = node
+				docs = []*ast.CommentGroup{node.Doc, node.Comment}
+			}
 
-	for _, lpkg := range gen.program.Created {
-		for _, file := range lpkg.Files {
-			for _, decl := range file.Decls {
-				genDecl, ok := decl.(*ast.GenDecl)
-				if ok {
-					genDecls = append(genDecls, genDecl)
+		case *ast.ValueSpec:
+			for _, name := range node.Names {
+				if pkg.Defs[name] == obj {
+					spec = node
+					docs = []*ast.CommentGroup{node.Doc, node.Comment}
 				}
 			}
 		}
 	}
 
-	for _, genDecl := range genDecls {
-		for _, spec := range genDecl.Specs {
-			typeSpec, ok := spec.(*ast.TypeSpec)
-			if !ok {
-				continue
+	if genDecl == nil || spec == nil {
+		return nil, nil, nil, nil, false
+	}
+
+	for _, cg := range append([]*ast.CommentGroup{genDecl.Doc}, docs...) {
+		if args, ok := typeVariableComment(cg); ok {
+			return pkg, file, spec, args, true
+		}
+	}
+
+	return nil, nil, nil, nil, false
+}
+
+// lengthVariable returns the name of the length variable of the array type pat
+// in the patterns of stmt, e.g. N of [N]T, or "" if its length is not a variable.
+// Length variables are constants declared with the comment "+tsgen typevar".
+func (gen *Gen) lengthVariable(stmt *typeSwitchStmt, pat *types.Array) string {
+	var name string
+
+	for _, clause := range stmt.node.Body.List {
+		for _, expr := range clause.(*ast.CaseClause).List {
+			ast.Inspect(expr, func(node ast.Node) bool {
+				arrayType, ok := node.(*ast.ArrayType)
+				if !ok || arrayType.Len == nil || stmt.info.TypeOf(arrayType) != types.Type(pat) {
+					return name == ""
+				}
+
+				if ident, ok := arrayType.Len.(*ast.Ident); ok {
+					if c, ok := stmt.info.Uses[ident].(*types.Const); ok {
+						if _, _, _, _, ok := gen.typeVariableDecl(c); ok {
+							name = c.Name()
+						}
+					}
+				}
+
+				return false
+			})
+		}
+	}
+
+	return name
+}
+
+// arrayLength is the length of an array bound to a length variable.
+// It is a types.Type so that it can be in typeMatchResult.
+type arrayLength int64
+
+func (l arrayLength) Underlying() types.Type { return l }
+func (l arrayLength) String() string         { return strconv.FormatInt(int64(l), 10) }
+
+// lookupInterface resolves an interface type name in file of pkg,
+// e.g. "Stringer", "fmt.Stringer" or "github.com/motemen/go-typeswitch-gen.Interface".
+func (gen *Gen) lookupInterface(pkg *loader.PackageInfo, file *ast.File, name string) *types.Interface {
+	var scope *types.Scope
+
+	dot := strings.LastIndex(name, ".")
+	if dot == -1 {
+		scope = pkg.Pkg.Scope()
+	} else {
+		ref := name[0:dot]
+		name = name[dot+1:]
+
+		for _, spec := range file.Imports {
+			var pkgName *types.PkgName
+			if spec.Name != nil {
+				pkgName, _ = pkg.Defs[spec.Name].(*types.PkgName)
+			} else {
+				pkgName, _ = pkg.Implicits[spec].(*types.PkgName)
+			}
+
+			if pkgName != nil && pkgName.Name() == ref {
+				scope = pkgName.Imported().Scope()
+				break
 			}
+		}
 
-			if isTypeVariableComment(genDecl.Doc) || isTypeVariableComment(typeSpec.Comment) {
-				if typeSpec.Name.Name == t.Obj().Name() {
-					return true
+		if scope == nil {
+			for _, p := range gen.program.AllPackages {
+				if p.Pkg.Path() == ref {
+					scope = p.Pkg.Scope()
+					break
 				}
 			}
 		}
 	}
 
-	return false
+	if scope == nil {
+		return nil
+	}
+
+	tn, ok := scope.Lookup(name).(*types.TypeName)
+	if !ok {
+		return nil
+	}
+
+	it, _ := tn.Type().Underlying().(*types.Interface)
+	return it
 }
 
-// isTypeVariableComment checks if cg is a comment like:
+// typeVariableComment checks if cg is a comment like:
 //   // +tsgen typevar
 // or
 //   /* +tsgen typevar */
-// .
-func isTypeVariableComment(cg *ast.CommentGroup) bool {
+// and returns the arguments following "typevar".
+func typeVariableComment(cg *ast.CommentGroup) ([]string, bool) {
 	if cg == nil {
-		return false
+		return nil, false
 	}
 
 	for _, c := range cg.List {
-		comment := strings.TrimSpace(c.Text[2:])
+		comment := commentText(c)
 		if strings.HasPrefix(comment, "+tsgen typevar") {
-			return true
+			return strings.Fields(strings.TrimPrefix(comment, "+tsgen typevar")), true
 		}
 	}
 
-	return false
+	return nil, false
+}
+
+// commentText returns the text of c without the comment markers and surrounding spaces.
+func commentText(c *ast.Comment) string {
+	return strings.TrimSpace(strings.TrimSuffix(c.Text[2:], "*/"))
 }
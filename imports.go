@@ -0,0 +1,327 @@
+package gen
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/loader"
+)
+
+// importManager manages the imports of a file being rewritten.
+// It adds imports for the packages the generated code refers to,
+// and removes the ones no longer used after rewriting.
+type importManager struct {
+	fset *token.FileSet
+	file *ast.File
+	pkg  *types.Package
+
+	// names maps import paths to their local names in the file.
+	names map[string]string
+
+	// taken is the set of the names which cannot be used for new imports.
+	taken map[string]bool
+
+	// usedBefore is the set of import paths used before rewriting.
+	usedBefore map[string]bool
+}
+
+func newImportManager(fset *token.FileSet, pkg *loader.PackageInfo, file *ast.File) *importManager {
+	im := &importManager{
+		fset:  fset,
+		file:  file,
+		pkg:   pkg.Pkg,
+		names: map[string]string{},
+		taken: map[string]bool{},
+	}
+
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+
+		var name string
+		if spec.Name != nil {
+			name = spec.Name.Name
+		} else if pkgName, ok := pkg.Implicits[spec].(*types.PkgName); ok {
+			name = pkgName.Imported().Name()
+		} else {
+			// Not type checked e.g. "C"
+			continue
+		}
+
+		if name == "_" {
+			continue
+		}
+
+		im.names[path] = name
+		im.taken[name] = true
+	}
+
+	// Identifiers declared in the file may shadow the package names
+	for ident := range pkg.Defs {
+		if file.Pos() <= ident.Pos() && ident.Pos() < file.End() {
+			im.taken[ident.Name] = true
+		}
+	}
+	for _, name := range pkg.Pkg.Scope().Names() {
+		im.taken[name] = true
+	}
+
+	im.usedBefore = im.usedImports()
+
+	return im
+}
+
+// localName returns the name by which the file refers to pkg,
+// adding an import declaration if needed.
+// Returns "" for the file's own package and dot-imported ones.
+func (im *importManager) localName(pkg *types.Package) string {
+	if pkg == nil || pkg == im.pkg {
+		return ""
+	}
+
+	if name, ok := im.names[pkg.Path()]; ok {
+		if name == "." {
+			return ""
+		}
+		return name
+	}
+
+	name := pkg.Name()
+	for i := 2; im.taken[name]; i++ {
+		name = pkg.Name() + strconv.Itoa(i)
+	}
+
+	if name == pkg.Name() {
+		astutil.AddImport(im.fset, im.file, pkg.Path())
+	} else {
+		astutil.AddNamedImport(im.fset, im.file, name, pkg.Path())
+	}
+
+	im.names[pkg.Path()] = name
+	im.taken[name] = true
+
+	return name
+}
+
+// qualifier is a types.Qualifier relative to the file.
+func (im *importManager) qualifier(pkg *types.Package) string {
+	return im.localName(pkg)
+}
+
+// inaccessible returns the unexported named type of another package t refers to,
+// which cannot be written in the file, or nil if there is none.
+func (im *importManager) inaccessible(t types.Type) *types.TypeName {
+	var found *types.TypeName
+
+	var walk func(t types.Type) bool
+	walk = func(t types.Type) bool {
+		named, ok := t.(*types.Named)
+		if !ok {
+			return found == nil
+		}
+
+		obj := named.Obj()
+		if obj.Pkg() != nil && obj.Pkg() != im.pkg && !obj.Exported() {
+			found = obj
+			return false
+		}
+
+		for i := 0; i < named.TypeArgs().Len(); i++ {
+			walkType(named.TypeArgs().At(i), walk)
+		}
+
+		return found == nil
+	}
+	walkType(t, walk)
+
+	return found
+}
+
+// typeString returns the string representation of t valid in the file,
+// e.g. map[string][]*list.List, and imports the packages it refers to.
+func (im *importManager) typeString(t types.Type) string {
+	expr, err := im.typeExpr(t)
+	if err != nil {
+		return types.TypeString(t, im.qualifier)
+	}
+
+	var buf bytes.Buffer
+	format.Node(&buf, token.NewFileSet(), expr)
+	return buf.String()
+}
+
+// typeExpr is typeString which returns an expression.
+// The expression has no positions so that it can be put anywhere in the file,
+// and the parameters of function types in it are unnamed.
+func (im *importManager) typeExpr(t types.Type) (ast.Expr, error) {
+	return im.typeExprAt(t, token.NoPos)
+}
+
+// typeExprAt is typeExpr which returns an expression placed at pos,
+// to replace an expression at pos in the file.
+func (im *importManager) typeExprAt(t types.Type, pos token.Pos) (ast.Expr, error) {
+	expr, err := parser.ParseExpr(types.TypeString(t, im.qualifier))
+	if err != nil {
+		return nil, err
+	}
+
+	ast.Inspect(expr, func(node ast.Node) bool {
+		if ft, ok := node.(*ast.FuncType); ok {
+			unnameFields(ft.Params)
+			unnameFields(ft.Results)
+		}
+		return true
+	})
+
+	setPos(expr, pos)
+
+	return expr, nil
+}
+
+// setPos sets all the valid positions in node to pos.
+// The invalid ones are kept, as some of them mean the absence of the tokens e.g. GenDecl.Lparen.
+func setPos(node ast.Node, pos token.Pos) {
+	posType := reflect.TypeOf(token.NoPos)
+	ast.Inspect(node, func(node ast.Node) bool {
+		if node == nil {
+			return false
+		}
+
+		v := reflect.ValueOf(node).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.Type() == posType && f.Int() != int64(token.NoPos) {
+				f.SetInt(int64(pos))
+			}
+		}
+
+		return true
+	})
+}
+
+// copyNode returns a deep copy of node.
+// The objects and scopes the identifiers refer to are shared, not copied.
+func copyNode(node ast.Node) ast.Node {
+	return copyValue(reflect.ValueOf(node)).Interface().(ast.Node)
+}
+
+var (
+	objectType = reflect.TypeOf((*ast.Object)(nil))
+	scopeType  = reflect.TypeOf((*ast.Scope)(nil))
+)
+
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || v.Type() == objectType || v.Type() == scopeType {
+			return v
+		}
+
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(copyValue(v.Elem()))
+		return c
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+
+		c := reflect.New(v.Type()).Elem()
+		c.Set(copyValue(v.Elem()))
+		return c
+
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			c.Field(i).Set(copyValue(v.Field(i)))
+		}
+		return c
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return c
+	}
+
+	return v
+}
+
+// unnameFields removes the names of the fields in list, e.g. (x, y int) to (int, int).
+func unnameFields(list *ast.FieldList) {
+	if list == nil {
+		return
+	}
+
+	fields := []*ast.Field{}
+	for _, f := range list.List {
+		fields = append(fields, &ast.Field{Type: f.Type})
+		for i := 1; i < len(f.Names); i++ {
+			fields = append(fields, &ast.Field{Type: copyNode(f.Type).(ast.Expr)})
+		}
+	}
+	list.List = fields
+}
+
+// removeUnused removes the imports which were used before rewriting
+// but are not any longer.
+func (im *importManager) removeUnused() {
+	used := im.usedImports()
+
+	for path, name := range im.names {
+		if name == "." || !im.usedBefore[path] || used[path] {
+			continue
+		}
+
+		for _, spec := range im.file.Imports {
+			if p, _ := strconv.Unquote(spec.Path.Value); p != path {
+				continue
+			}
+
+			if spec.Name != nil {
+				astutil.DeleteNamedImport(im.fset, im.file, spec.Name.Name, path)
+			} else {
+				astutil.DeleteImport(im.fset, im.file, path)
+			}
+			break
+		}
+
+		delete(im.names, path)
+	}
+}
+
+// usedImports returns the set of import paths referred by qualified identifiers in the file.
+// As the rewritten nodes are not type checked, the identifiers are matched by their names.
+func (im *importManager) usedImports() map[string]bool {
+	paths := map[string]string{}
+	for path, name := range im.names {
+		paths[name] = path
+	}
+
+	used := map[string]bool{}
+	ast.Inspect(im.file, func(node ast.Node) bool {
+		if sel, ok := node.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok {
+				if path, ok := paths[ident.Name]; ok {
+					used[path] = true
+				}
+			}
+		}
+		return true
+	})
+
+	return used
+}
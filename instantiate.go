@@ -0,0 +1,199 @@
+package gen
+
+import (
+	"strings"
+
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"golang.org/x/tools/go/loader"
+)
+
+// instantiateDirective is the prefix of the comments giving the types
+// to expand the templates with, in addition to or instead of the analysis.
+// A directive right above a type switch lists the types of its subject:
+//
+//   //tsgen:instantiate map[string]int, map[string]*bytes.Buffer
+//   switch m := m.(type) {
+//
+// A directive anywhere in the package, e.g. in a separate file, names a function
+// and lists the types of its parameters, as if it were called:
+//
+//   //tsgen:instantiate foreach([]int, func(int, int))
+//
+// The types are resolved in the scope of the type switch or of the file, respectively.
+const instantiateDirective = "//tsgen:instantiate "
+
+// instantiateDirectiveText returns the text after the directive prefix in c.
+func instantiateDirectiveText(c *ast.Comment) (string, bool) {
+	if !strings.HasPrefix(c.Text, instantiateDirective) {
+		return "", false
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(c.Text, instantiateDirective)), true
+}
+
+// parseInstantiation parses the text of a directive.
+// If it names a function, the call expression is returned.
+func parseInstantiation(text string) (*ast.CallExpr, bool) {
+	expr, err := parser.ParseExpr(text)
+	if err != nil {
+		return nil, false
+	}
+
+	call, ok := expr.(*ast.CallExpr)
+	return call, ok
+}
+
+// switchInstantiations returns the argument tuples of the types
+// listed in the directives right above the type switch sw in file,
+// which are keyed by subjectObj.
+func (g *Gen) switchInstantiations(pkg *loader.PackageInfo, file *ast.File, sw *ast.TypeSwitchStmt, subjectObj types.Object) ([]argTuple, error) {
+	fset := g.Loader.Fset
+	line := fset.Position(sw.Pos()).Line
+
+	tuples := []argTuple{}
+	for _, cg := range file.Comments {
+		if fset.Position(cg.End()).Line != line-1 {
+			continue
+		}
+
+		for _, c := range cg.List {
+			text, ok := instantiateDirectiveText(c)
+			if !ok {
+				continue
+			}
+
+			if _, ok := parseInstantiation(text); ok {
+				// Names a function
+				continue
+			}
+
+			// Parsed as the arguments of a call
+			text = "_(" + text + ")"
+			call, ok := parseInstantiation(text)
+			if !ok {
+				return nil, g.errorf(c, "could not parse types: %s", text)
+			}
+
+			inTypes, err := g.evalTypes(pkg, c, text, call.Args, sw.Pos())
+			if err != nil {
+				return nil, err
+			}
+
+			for _, in := range inTypes {
+				tuples = append(tuples, argTuple{
+					args:      map[types.Object]types.Type{subjectObj: in},
+					directive: c.Pos(),
+				})
+			}
+		}
+	}
+
+	return tuples, nil
+}
+
+// funcInstantiations returns the argument tuples given by the directives in pkg
+// naming the function fn, for subjects which are the parameters of fn.
+// Function literals cannot be named by the directives.
+func (g *Gen) funcInstantiations(pkg *loader.PackageInfo, fn ast.Node, subjects []types.Object) ([]argTuple, error) {
+	decl, ok := fn.(*ast.FuncDecl)
+	if !ok {
+		return nil, nil
+	}
+
+	fnObj, ok := pkg.Defs[decl.Name].(*types.Func)
+	if !ok {
+		return nil, nil
+	}
+
+	params := fnObj.Type().(*types.Signature).Params()
+
+	tuples := []argTuple{}
+	for _, file := range pkg.Files {
+		for _, cg := range file.Comments {
+			for _, c := range cg.List {
+				text, ok := instantiateDirectiveText(c)
+				if !ok {
+					continue
+				}
+
+				call, ok := parseInstantiation(text)
+				if !ok || g.lookupFunc(pkg, c, text, call.Fun) != fnObj {
+					continue
+				}
+
+				if len(call.Args) != params.Len() {
+					return nil, g.errorf(c, "%s has %d parameters but %d types given", fnObj.Name(), params.Len(), len(call.Args))
+				}
+
+				inTypes, err := g.evalTypes(pkg, c, text, call.Args, c.Pos())
+				if err != nil {
+					return nil, err
+				}
+
+				tuple := argTuple{
+					args:      map[types.Object]types.Type{},
+					directive: c.Pos(),
+				}
+				for _, subject := range subjects {
+					if i := paramPos(&pkg.Info, subject, decl.Type.Params); i >= 0 {
+						tuple.args[subject] = inTypes[i]
+					}
+				}
+
+				tuples = append(tuples, tuple)
+			}
+		}
+	}
+
+	return tuples, nil
+}
+
+// lookupFunc returns the function or method named by expr, parsed from text,
+// in the directive c. expr is either f, T.f or (*T).f.
+func (g *Gen) lookupFunc(pkg *loader.PackageInfo, c *ast.Comment, text string, expr ast.Expr) types.Object {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return pkg.Pkg.Scope().Lookup(expr.Name)
+
+	case *ast.SelectorExpr:
+		tv, err := types.Eval(g.Loader.Fset, pkg.Pkg, c.Pos(), exprText(text, expr.X))
+		if err != nil || !tv.IsType() {
+			return nil
+		}
+
+		obj, _, _ := types.LookupFieldOrMethod(tv.Type, true, pkg.Pkg, expr.Sel.Name)
+		return obj
+	}
+
+	return nil
+}
+
+// evalTypes evaluates exprs, parsed from text, as types at pos in pkg.
+func (g *Gen) evalTypes(pkg *loader.PackageInfo, c *ast.Comment, text string, exprs []ast.Expr, pos token.Pos) ([]types.Type, error) {
+	inTypes := []types.Type{}
+	for _, expr := range exprs {
+		s := exprText(text, expr)
+
+		tv, err := types.Eval(g.Loader.Fset, pkg.Pkg, pos, s)
+		if err != nil {
+			return nil, g.errorf(c, "%s", err)
+		}
+
+		if !tv.IsType() {
+			return nil, g.errorf(c, "%s is not a type", s)
+		}
+
+		inTypes = append(inTypes, tv.Type)
+	}
+
+	return inTypes, nil
+}
+
+// exprText returns the source of expr parsed from text by parser.ParseExpr.
+func exprText(text string, expr ast.Expr) string {
+	// The positions are offsets in text plus one
+	return text[expr.Pos()-1 : expr.End()-1]
+}
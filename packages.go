@@ -0,0 +1,169 @@
+package gen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go/build"
+)
+
+// Package is a package found by ResolvePackages.
+type Package struct {
+	// ImportPath is the canonical path of the package, e.g. without the vendor directory.
+	ImportPath string
+
+	// Dir is the directory of the package.
+	Dir string
+
+	// GoFiles are the paths of the Go source files of the package, excluding the tests.
+	GoFiles []string
+}
+
+// listedPackage is a package listed by "go list -json".
+type listedPackage struct {
+	ImportPath string
+	Dir        string
+	GoFiles    []string
+	ImportMap  map[string]string
+	ForTest    string
+	DepOnly    bool
+	Error      *struct {
+		Err string
+	}
+}
+
+// ResolvePackages finds the packages matching patterns e.g. ./... by the go command,
+// which respects go.mod, go.work and vendor directories,
+// and makes g.Loader resolve the imports from them in the same way.
+// The patterns are relative to g.Loader.Cwd.
+// It returns the packages matched in the order of their paths;
+// add them to g.Loader by Import or ImportWithTests with their ImportPath to load them.
+func (g *Gen) ResolvePackages(patterns ...string) ([]*Package, error) {
+	args := []string{"list", "-e", "-json", "-deps", "-test"} // -test for the imports of the test files
+	if g.Loader.Build != nil && len(g.Loader.Build.BuildTags) > 0 {
+		args = append(args, "-tags="+strings.Join(g.Loader.Build.BuildTags, ","))
+	}
+	args = append(args, "--")
+	args = append(args, patterns...)
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("go", args...)
+	cmd.Dir = g.Loader.Cwd
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go list: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if g.resolver == nil {
+		g.resolver = &packageResolver{
+			byPath: map[string]*listedPackage{},
+			byDir:  map[string][]*listedPackage{},
+		}
+		g.Loader.FindPackage = g.resolver.findPackage
+	}
+
+	matched := []*Package{}
+
+	dec := json.NewDecoder(&stdout)
+	for {
+		var lp listedPackage
+		err := dec.Decode(&lp)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		g.resolver.add(&lp)
+
+		// Skip the test variants e.g. "foo [foo.test]", "foo_test [foo.test]" and "foo.test"
+		if lp.DepOnly || lp.ForTest != "" || strings.HasSuffix(lp.ImportPath, ".test") {
+			continue
+		}
+
+		if lp.Error != nil && !g.Loader.AllowErrors {
+			return nil, fmt.Errorf("%s: %s", lp.ImportPath, lp.Error.Err)
+		}
+
+		pkg := &Package{
+			ImportPath: lp.ImportPath,
+			Dir:        lp.Dir,
+		}
+		for _, name := range lp.GoFiles {
+			pkg.GoFiles = append(pkg.GoFiles, filepath.Join(lp.Dir, name))
+		}
+
+		matched = append(matched, pkg)
+	}
+
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no packages match %s", strings.Join(patterns, " "))
+	}
+
+	sort.Sort(byImportPath(matched))
+
+	return matched, nil
+}
+
+// packageResolver resolves the imports to the packages listed by the go command.
+type packageResolver struct {
+	// byPath maps import paths to the packages, without test variants.
+	byPath map[string]*listedPackage
+
+	// byDir maps directories to the packages in them, including test variants,
+	// to resolve the imports of their files.
+	byDir map[string][]*listedPackage
+}
+
+func (r *packageResolver) add(lp *listedPackage) {
+	if lp.Dir == "" {
+		return
+	}
+
+	r.byDir[lp.Dir] = append(r.byDir[lp.Dir], lp)
+
+	if lp.ForTest == "" && !strings.HasSuffix(lp.ImportPath, ".test") {
+		r.byPath[lp.ImportPath] = lp
+	}
+}
+
+// findPackage implements loader.Config.FindPackage.
+// The packages not listed by the go command, e.g. ones imported only by the files
+// excluded by build tags, are looked up by go/build.
+func (r *packageResolver) findPackage(ctxt *build.Context, importPath, fromDir string, mode build.ImportMode) (*build.Package, error) {
+	path := importPath
+	for _, from := range r.byDir[fromDir] {
+		if resolved, ok := from.ImportMap[importPath]; ok {
+			// e.g. vendored packages have the paths different from importPath,
+			// and the test variants have the suffixes like " [foo.test]"
+			path = strings.SplitN(resolved, " ", 2)[0]
+			break
+		}
+	}
+
+	lp := r.byPath[path]
+	if lp == nil {
+		return ctxt.Import(importPath, fromDir, mode)
+	}
+
+	bp, err := ctxt.ImportDir(lp.Dir, mode)
+	if bp != nil {
+		bp.ImportPath = lp.ImportPath
+	}
+
+	return bp, err
+}
+
+type byImportPath []*Package
+
+func (s byImportPath) Len() int           { return len(s) }
+func (s byImportPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byImportPath) Less(i, j int) bool { return s[i].ImportPath < s[j].ImportPath }
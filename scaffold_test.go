@@ -13,17 +13,14 @@ func TestScaffold(t *testing.T) {
 
 	gen := New()
 	gen.FileWriter = func(path string) io.WriteCloser {
-		if path == "testdata/scaffold/node.go" {
+		if sameFile(path, "testdata/scaffold/node.go") {
 			return nopCloser{&out}
 		}
 
 		return nil
 	}
 
-	err = gen.Loader.CreateFromFilenames("", "testdata/scaffold/node.go")
-	if err != nil {
-		t.Fatal(err)
-	}
+	gen.Loader.CreateFromFilenames("", "testdata/scaffold/node.go")
 
 	err = gen.Scaffold()
 	if err != nil {
@@ -43,4 +40,9 @@ func TestScaffold(t *testing.T) {
 			t.Errorf("result must contain %q", exp)
 		}
 	}
+
+	// Type switches inside methods and other statements are scaffolded too
+	if n := strings.Count(result, "case *T2:"); n != 5 {
+		t.Errorf("result must contain 5 clauses for *T2 but got %d", n)
+	}
 }
@@ -5,8 +5,8 @@ import (
 
 	"go/ast"
 	"go/token"
+	"go/types"
 	"golang.org/x/tools/go/loader"
-	"golang.org/x/tools/go/types"
 )
 
 // sortFileTypeSwitches is the main logic for "sort" mode.
@@ -18,28 +18,22 @@ import (
 //   case C: // implements I1, I2
 //   case D: // implements I2
 // Will be sorted as C, B, D, A, as I2 is more popular than I1.
-func (g Gen) sortFileTypeSwitches(pkg *loader.PackageInfo, file *ast.File) error {
-	ast.Inspect(file, func(n ast.Node) bool {
-		if stmt, ok := n.(*ast.TypeSwitchStmt); ok {
-			sort.Sort(g.byInterface(stmt.Body.List, &pkg.Info))
-			// sort.Sort(byName{stmt.Body.List, g})
-
-			// Remove empty lines between cases
-			// as sorting cases will break the spacing.
-			for _, st := range stmt.Body.List {
-				if cc, ok := st.(*ast.CaseClause); ok {
-					cc.Case = token.NoPos
-					cc.Colon = token.NoPos
-				}
+func (g *Gen) sortFileTypeSwitches(pkg *loader.PackageInfo, file *ast.File) error {
+	return forTypeSwitchStmt(file, func(stmt *ast.TypeSwitchStmt, path []ast.Node) error {
+		sort.Sort(g.byInterface(stmt.Body.List, &pkg.Info))
+		// sort.Sort(byName{stmt.Body.List, g})
+
+		// Remove empty lines between cases
+		// as sorting cases will break the spacing.
+		for _, st := range stmt.Body.List {
+			if cc, ok := st.(*ast.CaseClause); ok {
+				cc.Case = token.NoPos
+				cc.Colon = token.NoPos
 			}
-
-			return false
 		}
 
-		return true
+		return nil
 	})
-
-	return nil
 }
 
 type byTypeName struct {
@@ -67,7 +61,7 @@ func (s byTypeName) Less(i, j int) bool {
 }
 
 // Sort case clauses by popularity (most polular to less)
-func (g Gen) byInterface(list []ast.Stmt, info *types.Info) byInterfacePopularity {
+func (g *Gen) byInterface(list []ast.Stmt, info *types.Info) byInterfacePopularity {
 	// First rank interfaces by their ocurrances
 	caseTypes := map[types.Type]bool{}
 
@@ -115,7 +109,7 @@ func (g Gen) byInterface(list []ast.Stmt, info *types.Info) byInterfacePopularit
 	return byInterfacePopularity{
 		list:       list,
 		interfaces: interfaceOrder,
-		gen:        &g,
+		gen:        g,
 		info:       info,
 	}
 }
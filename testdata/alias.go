@@ -0,0 +1,28 @@
+package testdata
+
+type T interface{}
+
+type MyMap = map[string]int
+
+func main() {
+	var m MyMap
+	keys(m)
+
+	apply(func(v any) bool { return v != nil })
+}
+
+func keys(m interface{}) {
+	switch m := m.(type) {
+	case map[string]T:
+		var v T
+		_ = m[""] == v
+	}
+}
+
+func apply(f interface{}) {
+	switch f := f.(type) {
+	case func(any) T:
+		var r T = f(nil)
+		_ = r
+	}
+}
@@ -0,0 +1,34 @@
+package testdata
+
+type T interface{}
+
+type _T interface{}
+
+func main() {
+	apply(func(x int) int { return x })
+	apply(func(s string) bool { return s == "" })
+
+	first([]int{}, 0)
+	first(map[bool]string{}, 0)
+}
+
+func apply(f interface{}) {
+	switch f := f.(type) {
+	case func(T) T:
+		var x T
+		_ = f(x)
+	case func(T) _T:
+		var x T
+		_ = f(x)
+	}
+}
+
+func first(c interface{}, i int) {
+	switch c := c.(type) {
+	case []_T:
+		_ = c[i]
+	case map[T]_T:
+		var k T
+		_ = c[k]
+	}
+}
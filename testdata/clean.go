@@ -0,0 +1,28 @@
+package testdata
+
+import (
+	"container/list"
+)
+
+type T interface{}
+
+func keys(m interface{}) []string {
+	switch m := m.(type) {
+	case map[string]*list.List:
+		// +tsgen generated from map[string]T
+		keys := make([]string, 0, len(m))
+		return keys
+	case map[string]bool:
+		// +tsgen generated from map[string]T
+		keys := make([]string, 0, len(m))
+		return keys
+	case map[string]int:
+		// hand-written
+		return nil
+	case map[string]T:
+		keys := make([]string, 0, len(m))
+		return keys
+	}
+
+	return nil
+}
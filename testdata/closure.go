@@ -0,0 +1,43 @@
+package testdata
+
+type T interface{}
+
+func main() {
+	// Captured and read by the closure
+	var v interface{} = map[string]int{}
+	func() {
+		keys(v)
+	}()
+
+	// Assigned by the closure
+	var w interface{}
+	set := func() {
+		w = map[string]bool{}
+	}
+	set()
+	keys(w)
+
+	// Captured by the nested closures
+	var x interface{} = map[string]byte{}
+	func() {
+		func() {
+			keys(x)
+		}()
+	}()
+
+	// A parameter captured by the closure
+	each(map[string]int8{})
+}
+
+func each(m interface{}) {
+	func() {
+		keys(m)
+	}()
+}
+
+func keys(m interface{}) {
+	switch m := m.(type) {
+	case map[string]T:
+		_ = m
+	}
+}
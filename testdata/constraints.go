@@ -0,0 +1,60 @@
+package testdata
+
+import (
+	"io"
+)
+
+// +tsgen typevar numeric
+type NumT float64
+
+// +tsgen typevar implements=io.Reader
+type ReaderT interface{}
+
+// +tsgen typevar
+type CloserT interface {
+	Close() error
+}
+
+// +tsgen typevar numric
+type TypoT interface{}
+
+type T interface{}
+
+var _ io.Reader = (*buffer)(nil)
+
+type buffer struct{}
+
+func (*buffer) Read(p []byte) (int, error) { return 0, nil }
+
+type conn struct{}
+
+func (conn) Close() error { return nil }
+
+func main() {
+	sum([]int{})
+	sum([]float32{})
+	sum([]*buffer{})
+	sum([]conn{})
+	sum([]bool{})
+}
+
+func sum(a interface{}) {
+	switch a := a.(type) {
+	case []NumT:
+		var s NumT
+		for _, x := range a {
+			s = s + x
+		}
+		_ = s
+	case []ReaderT:
+		_ = a
+	case []TypoT:
+		_ = a
+	case []CloserT:
+		for _, c := range a {
+			c.Close()
+		}
+	case []T:
+		_ = len(a)
+	}
+}
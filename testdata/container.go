@@ -0,0 +1,34 @@
+package testdata
+
+type T interface{}
+
+type box struct {
+	v int
+}
+
+func (b *box) Get() int { return b.v }
+
+type name struct{}
+
+func (name) Get() string { return "" }
+
+type pair struct{}
+
+func (pair) Get() (int, bool) { return 0, false }
+
+func main() {
+	get(&box{})
+	get(box{})
+	get(name{})
+	get(pair{})
+}
+
+func get(c interface{}) {
+	switch c := c.(type) {
+	case interface {
+		Get() T
+	}:
+		var x T = c.Get()
+		_ = x
+	}
+}
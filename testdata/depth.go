@@ -0,0 +1,45 @@
+package testdata
+
+type T interface{}
+
+func main() {
+	inIf(map[string]int{}, true)
+	inFor(map[string]bool{})
+	inDefer(map[string]string{})
+
+	var lit func(x interface{})
+	lit = func(x interface{}) {
+		switch x := x.(type) {
+		case map[string]T:
+			_ = x
+		}
+	}
+	lit(map[string]byte{})
+}
+
+func inIf(x interface{}, cond bool) {
+	if cond {
+		switch x := x.(type) {
+		case map[string]T:
+			_ = x
+		}
+	}
+}
+
+func inFor(x interface{}) {
+	for i := 0; i < 1; i++ {
+		switch x := x.(type) {
+		case map[string]T:
+			_ = x
+		}
+	}
+}
+
+func inDefer(x interface{}) {
+	defer func() {
+		switch x := x.(type) {
+		case map[string]T:
+			_ = x
+		}
+	}()
+}
@@ -0,0 +1,46 @@
+package testdata
+
+type T interface{}
+
+type holder struct {
+	v interface{}
+}
+
+func main() {
+	noAssign(map[string]int{})
+	paren(map[string]bool{})
+	others(map[string]interface{}{})
+}
+
+func noAssign(x interface{}) {
+	switch x.(type) {
+	case map[string]T:
+		var t T
+		_ = t
+	}
+}
+
+func paren(x interface{}) {
+	switch x := (x).(type) {
+	case map[string]T:
+		_ = x
+	}
+}
+
+func get() interface{} { return nil }
+
+func others(m map[string]interface{}) {
+	h := holder{v: m}
+	switch v := h.v.(type) {
+	case map[string]T:
+		_ = v
+	}
+	switch v := get().(type) {
+	case map[string]T:
+		_ = v
+	}
+	switch v := m["k"].(type) {
+	case map[string]T:
+		_ = v
+	}
+}
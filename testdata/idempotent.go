@@ -0,0 +1,25 @@
+package testdata
+
+type T interface{}
+
+func main() {
+	keys(map[string]int{})
+	keys(map[string]bool{})
+	keys(map[string][]byte{})
+}
+
+func keys(m interface{}) []string {
+	switch m := m.(type) {
+	case map[string]int:
+		// hand-written
+		return nil
+	case map[string]T:
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		return keys
+	}
+
+	return nil
+}
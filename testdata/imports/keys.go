@@ -0,0 +1,19 @@
+package imports
+
+import "container/list"
+
+type T interface{}
+
+func keys(m interface{}) {
+	var l *list.List
+	_ = l
+
+	// ring shadows the package name of container/ring
+	ring := 0
+	_ = ring
+
+	switch m := m.(type) {
+	case map[string]T:
+		_ = m
+	}
+}
@@ -0,0 +1,18 @@
+package imports
+
+import (
+	"container/list"
+	"container/ring"
+	"io"
+)
+
+func main() {
+	keys(map[string]*list.List{})
+	keys(map[string]*ring.Ring{})
+	keys(map[string]io.Reader{})
+	keys(map[string][]*list.List{})
+	keys(map[string]map[io.Reader]chan<- *ring.Ring{})
+	keys(map[string]*local{})
+}
+
+type local struct{}
@@ -0,0 +1,42 @@
+package testdata
+
+import (
+	"container/list"
+	"io"
+)
+
+type T interface{}
+
+var (
+	_ io.Reader
+	_ list.List
+)
+
+func main() {
+	keys(map[string]bool{})
+}
+
+//tsgen:instantiate foreach([]int, func(int, int))
+//tsgen:instantiate foreach([]*list.List, func(int, *list.List))
+
+func keys(m interface{}) {
+	//tsgen:instantiate map[string]int, map[string]io.Reader
+	switch m := m.(type) {
+	case map[string]T:
+		for k := range m {
+			_ = k
+		}
+	}
+}
+
+func foreach(a interface{}, cb interface{}) {
+	switch a := a.(type) {
+	case []T:
+		switch cb := cb.(type) {
+		case func(int, T):
+			for i, e := range a {
+				cb(i, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package testdata
+
+type T interface{}
+
+type box struct {
+	v interface{}
+}
+
+func main() {
+	local("")
+	field(box{v: map[string]int8{}})
+	ch := make(chan interface{}, 1)
+	ch <- map[string]int16{}
+	recv(ch)
+}
+
+func decode(s string) interface{} {
+	if s == "" {
+		return map[string]int32{}
+	}
+	return map[string]int64{}
+}
+
+func local(s string) {
+	v := decode(s)
+	switch v := v.(type) {
+	case map[string]T:
+		_ = v
+	}
+}
+
+func field(b box) {
+	switch v := b.v.(type) {
+	case map[string]T:
+		_ = v
+	}
+}
+
+func recv(ch chan interface{}) {
+	switch v := (<-ch).(type) {
+	case map[string]T:
+		_ = v
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"mains/decode"
+	"mains/keys"
+)
+
+func main() {
+	keys.Keys(map[string]int{})
+	keys.Keys(decode.Decode("float"))
+	keys.Keys(decode.Decode("secret"))
+}
@@ -0,0 +1,12 @@
+package main
+
+import "mains/keys"
+
+func keysOf(m interface{}) []string {
+	return keys.Keys(m)
+}
+
+func main() {
+	keysOf(map[string]bool{})
+	keysOf(map[string][]byte{})
+}
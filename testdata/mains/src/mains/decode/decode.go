@@ -0,0 +1,15 @@
+package decode
+
+// Decode creates a value not knowing mains/keys, which its caller passes to the template.
+func Decode(kind string) interface{} {
+	if kind == "float" {
+		return map[string]float64{}
+	}
+	if kind == "secret" {
+		return map[string]*secret{}
+	}
+
+	return nil
+}
+
+type secret struct{}
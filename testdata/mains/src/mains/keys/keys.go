@@ -0,0 +1,16 @@
+package keys
+
+type T interface{}
+
+func Keys(m interface{}) []string {
+	switch m := m.(type) {
+	case map[string]T:
+		ks := []string{}
+		for k := range m {
+			ks = append(ks, k)
+		}
+		return ks
+	}
+
+	return nil
+}
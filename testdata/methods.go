@@ -0,0 +1,50 @@
+package testdata
+
+type T interface{}
+
+type Keyer interface {
+	Keys(m interface{}) []string
+}
+
+type keyer struct{}
+
+func main() {
+	var k keyer
+	k.Keys(map[string]int{})
+
+	var i Keyer = k
+	i.Keys(map[string]bool{})
+
+	f := k.Keys
+	f(map[string]byte{})
+
+	(*keyer).Keys(&k, map[string]int8{})
+
+	variadic(map[string]int16{}, map[string]int32{})
+}
+
+func (k keyer) Keys(m interface{}) []string {
+	switch m := m.(type) {
+	case map[string]T:
+		ks := []string{}
+		for key := range m {
+			ks = append(ks, key)
+		}
+		return ks
+	}
+	return nil
+}
+
+func variadic(args ...interface{}) {
+	for _, a := range args {
+		switch a := a.(type) {
+		case map[string]T:
+			_ = a
+		}
+	}
+
+	switch a := args[0].(type) {
+	case map[string]T:
+		_ = a
+	}
+}
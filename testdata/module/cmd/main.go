@@ -0,0 +1,11 @@
+package main
+
+import (
+	"example.com/dep"
+	"example.com/module/keys"
+)
+
+func main() {
+	keys.Keys(map[string]int{})
+	keys.Keys(map[string]*dep.Value{})
+}
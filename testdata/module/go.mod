@@ -0,0 +1,5 @@
+module example.com/module
+
+go 1.16
+
+require example.com/dep v1.0.0
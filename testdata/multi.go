@@ -0,0 +1,42 @@
+package testdata
+
+import (
+	"io"
+)
+
+type T interface{}
+
+func main() {
+	keys(map[string]int{})
+	keys(map[string]io.Reader{})
+	keys(map[int]int{})
+	keys(map[int]bool{})
+
+	count(map[string]int{})
+	count(map[int]bool{})
+	count([]byte{})
+}
+
+func keys(m interface{}) []T {
+	switch m := m.(type) {
+	case map[string]T, map[int]T:
+		var values []T
+		_ = m
+		return values
+	}
+
+	return nil
+}
+
+func count(m interface{}) int {
+	switch m := m.(type) {
+	case map[string]T, map[int]T, []byte:
+		return lengthOf(m)
+	}
+
+	return 0
+}
+
+func lengthOf(v interface{}) int {
+	return 0
+}
@@ -0,0 +1,32 @@
+package testdata
+
+type T interface{}
+
+func main() {
+	foreach([]string{"a", "bb"}, func(i int, s string) {})
+	foreach([]bool{true, false}, func(i int, b bool) {})
+
+	outer(1, []string{})
+}
+
+func foreach(a interface{}, cb interface{}) {
+	switch a := a.(type) {
+	case []T:
+		switch cb := cb.(type) {
+		case func(int, T):
+			for i, e := range a {
+				cb(i, e)
+			}
+		}
+	}
+}
+
+func outer(a interface{}, b interface{}) {
+	switch a.(type) {
+	case int:
+		switch b := b.(type) {
+		case []T:
+			_ = len(b)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package testdata
+
+func main() {
+	describe("s")
+	values(map[string]int{})
+
+	var v interface{} = 1.5
+	switch v.(type) {
+	case int:
+		println("int")
+	}
+}
+
+// describe has an ordinary type switch, which is not expanded
+func describe(v interface{}) string {
+	switch v.(type) {
+	case int:
+		return "int"
+	case bool:
+		return "bool"
+	}
+
+	return "unknown"
+}
+
+type T interface{}
+
+// values has a template clause and the default clause, which handles the types not matching the template
+func values(m interface{}) int {
+	switch m := m.(type) {
+	case []T:
+		return len(m)
+	default:
+		return 0
+	}
+}
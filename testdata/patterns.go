@@ -0,0 +1,76 @@
+package testdata
+
+type T interface{}
+
+// +tsgen typevar
+const N = 1
+
+func main() {
+	sum([3]int{})
+	sum([5]bool{})
+	sum([2]string{})
+
+	recv(make(chan int))
+	recv(make(<-chan bool))
+	recv(make(chan<- string))
+
+	size(make(chan int8))
+	size(make(<-chan int16))
+	size(make(chan<- int32))
+
+	call(func(...int) {})
+	call(func([]bool) {})
+
+	field(struct{ Name int }{})
+	field(struct {
+		Name bool `json:"name"`
+	}{})
+	field(struct{ Value string }{})
+}
+
+func sum(a interface{}) {
+	switch a := a.(type) {
+	case [3]T:
+		_ = a[2]
+	case [N]T:
+		var b [N]T
+		copy(b[:], a[:])
+	}
+}
+
+func recv(c interface{}) {
+	switch c := c.(type) {
+	case <-chan T:
+		var x T = <-c
+		_ = x
+	}
+}
+
+func size(c interface{}) int {
+	switch c := c.(type) {
+	case chan T: // +tsgen anydir
+		return cap(c)
+	}
+
+	return 0
+}
+
+func call(f interface{}) {
+	switch f := f.(type) {
+	case func(...T):
+		f()
+	case func([]T):
+		f(nil)
+	}
+}
+
+func field(s interface{}) {
+	switch s := s.(type) {
+	case struct{ Name T }:
+		_ = s.Name
+	case struct {
+		Name T `json:"name"`
+	}:
+		_ = s.Name
+	}
+}
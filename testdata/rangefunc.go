@@ -0,0 +1,25 @@
+package testdata
+
+type T interface{}
+
+func main() {
+	keys(map[string]int{})
+}
+
+func keys(m interface{}) {
+	switch m := m.(type) {
+	case map[string]T:
+		for range each(len(m)) {
+		}
+	}
+}
+
+func each(n int) func(yield func(int) bool) {
+	return func(yield func(int) bool) {
+		for i := 0; i < n; i++ {
+			if !yield(i) {
+				return
+			}
+		}
+	}
+}
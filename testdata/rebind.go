@@ -0,0 +1,27 @@
+package testdata
+
+import (
+	"fmt"
+)
+
+type T interface{}
+
+func main() {
+	describe([]int{})
+	describe(map[string]bool{})
+}
+
+func describe(v interface{}) string {
+	switch v := v.(type) {
+	case []T, map[string]T:
+		if s, ok := v.(fmt.Stringer); ok {
+			return s.String()
+		}
+
+		var zero T
+		v = zero
+		return fmt.Sprint(v)
+	}
+
+	return ""
+}
@@ -18,3 +18,31 @@ func f(i I) {
 		_ = i
 	}
 }
+
+func (t T1) g(i I) {
+	if i != nil {
+		switch i := i.(type) {
+		default:
+			_ = i
+		}
+	}
+}
+
+type holder struct {
+	i I
+}
+
+func get() I { return nil }
+
+func forms(h holder, m map[string]I) {
+	switch h.i.(type) {
+	}
+	switch i := get().(type) {
+	default:
+		_ = i
+	}
+	switch i := (m["k"]).(type) {
+	default:
+		_ = i
+	}
+}
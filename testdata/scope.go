@@ -0,0 +1,39 @@
+package testdata
+
+import (
+	"io"
+)
+
+type T interface{}
+
+type holder struct {
+	T int
+}
+
+func main() {
+	scope([]map[string]io.Reader{})
+}
+
+func scope(v interface{}) {
+	switch v := v.(type) {
+	case []T:
+		var x T
+		if len(v) > 0 {
+			x = v[0]
+		}
+		_ = x
+
+		h := holder{T: 1}
+		_ = h.T
+
+		{
+			T := 2
+			_ = T
+		}
+
+	T:
+		for range v {
+			break T
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package testdata
+
+type T interface{}
+
+// +tsgen typevar
+const N = 1
+
+func main() {
+	f([]int{})
+	f([]chan<- bool{})
+	f([2]string{})
+	f([3]string{})
+	f(map[string]int{})
+}
+
+func f(a interface{}) {
+	switch a := a.(type) {
+	case []T:
+		_ = len(a)
+	case []chan<- T:
+		var x T
+		a[0] <- x
+	case [N]T:
+		_ = a[N-1]
+	case [2]T:
+		_ = a[1]
+	case map[string]T:
+		var v T = a[""]
+		_ = v
+	case map[T]int:
+		var k T
+		_ = a[k]
+	}
+}
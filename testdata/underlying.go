@@ -0,0 +1,63 @@
+package testdata
+
+type T interface{}
+
+// +tsgen typevar underlying
+type E interface{}
+
+type in1 map[string][]int
+
+type list []bool
+
+func main() {
+	keys(in1{})
+	keys(map[string]string{})
+
+	keysExact(in1{})
+
+	first(list{})
+
+	describe(in1{})
+}
+
+func keys(m interface{}) {
+	switch m := m.(type) {
+	case map[string]T: // +tsgen underlying
+		for k := range m {
+			_ = k
+		}
+		var x map[string]T = m
+		_ = x
+		m = nil
+	}
+}
+
+func keysExact(m interface{}) {
+	switch m := m.(type) {
+	case map[string]T:
+		_ = m
+	}
+}
+
+func first(a interface{}) {
+	switch a := a.(type) {
+	case []E:
+		_ = a[0]
+	}
+}
+
+func describe(m interface{}) interface{} {
+	switch m := m.(type) {
+	case map[string]T: // +tsgen underlying
+		for k := range m {
+			show(k, m)
+		}
+		var v interface{} = m
+		_ = v
+		return m
+	}
+
+	return nil
+}
+
+func show(k string, v interface{}) {}
@@ -0,0 +1,26 @@
+package testdata
+
+type T interface{}
+
+type reader interface {
+	Read() string
+}
+
+type file struct{}
+
+func (file) Read() string { return "" }
+
+func main() {
+	keys(map[string]int{})
+	keys([]int{})
+	keys(file{})
+}
+
+func keys(m interface{}) {
+	switch m := m.(type) {
+	case map[string]T:
+		_ = m
+	case reader:
+		_ = m
+	}
+}
@@ -0,0 +1,54 @@
+package testdata
+
+type T interface{}
+
+type Stringer interface {
+	String() string
+}
+
+var cond bool
+
+type stringer struct{}
+
+func (stringer) String() string { return "" }
+
+func main() {
+	Keys(map[string]int{})
+	KeysAll(map[string]bool{}, map[string]byte{})
+	var s Stringer = stringer{}
+	Keys(s)
+
+	var m interface{}
+	if cond {
+		m = map[string]int8{}
+	} else {
+		m = map[string]int16{}
+	}
+	keys(m)
+}
+
+func Keys(m interface{}) []string {
+	return keys(m)
+}
+
+func KeysAll(ms ...interface{}) []string {
+	ks := []string{}
+	for _, m := range ms {
+		ks = append(ks, keys(m)...)
+	}
+	return ks
+}
+
+func keys(m interface{}) []string {
+	switch m := m.(type) {
+	case map[string]T:
+		ks := []string{}
+		for k := range m {
+			ks = append(ks, k)
+		}
+		return ks
+	case stringer:
+		return []string{m.String()}
+	}
+	return nil
+}
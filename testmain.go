@@ -0,0 +1,128 @@
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"golang.org/x/tools/go/ssa"
+)
+
+// createTestMain creates and builds the SSA package of a main function
+// which calls the tests, benchmarks and examples of pkgs, i.e. a package and its external test package.
+// The tests are called with nil arguments, which is sufficient for the analyses
+// as they only follow the values flowing from the tests.
+// It returns nil if pkgs have no tests.
+func (g *Gen) createTestMain(pkgs ...*ssa.Package) (*ssa.Package, error) {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "package main")
+
+	imported := map[string]*types.Package{}
+	calls := []string{}
+	for i, pkg := range pkgs {
+		name := fmt.Sprintf("p%d", i)
+
+		used := false
+		for _, mem := range pkg.Members {
+			fn, ok := mem.(*ssa.Function)
+			if !ok || !g.isTestFunc(fn) {
+				continue
+			}
+
+			if fn.Signature.Params().Len() == 0 {
+				calls = append(calls, fmt.Sprintf("%s.%s()", name, fn.Name()))
+			} else {
+				calls = append(calls, fmt.Sprintf("%s.%s(nil)", name, fn.Name()))
+			}
+			used = true
+		}
+
+		if used {
+			fmt.Fprintf(&buf, "import %s %q\n", name, pkg.Pkg.Path())
+			imported[pkg.Pkg.Path()] = pkg.Pkg
+		}
+	}
+
+	if len(calls) == 0 {
+		return nil, nil
+	}
+
+	fmt.Fprintf(&buf, "func main() {\n%s\n}\n", strings.Join(calls, "\n"))
+
+	path := pkgs[0].Pkg.Path() + ".test"
+	file, err := parser.ParseFile(g.program.Fset, path+"/main.go", buf.Bytes(), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if pkg, ok := imported[path]; ok {
+				return pkg, nil
+			}
+			return nil, fmt.Errorf("cannot import %s", path)
+		}),
+	}
+	info := &types.Info{
+		Types:      map[ast.Expr]types.TypeAndValue{},
+		Defs:       map[*ast.Ident]types.Object{},
+		Uses:       map[*ast.Ident]types.Object{},
+		Implicits:  map[ast.Node]types.Object{},
+		Selections: map[*ast.SelectorExpr]*types.Selection{},
+		Scopes:     map[ast.Node]*types.Scope{},
+	}
+	pkg, err := conf.Check(path, g.program.Fset, []*ast.File{file}, info)
+	if err != nil {
+		return nil, err
+	}
+
+	testMain := g.ssaProgram.CreatePackage(pkg, []*ast.File{file}, info, false)
+	testMain.Build()
+
+	return testMain, nil
+}
+
+// isTestFunc reports whether fn is a test, benchmark or example function
+// declared in a _test.go file.
+func (g *Gen) isTestFunc(fn *ssa.Function) bool {
+	if fn.Signature.Recv() != nil || fn.Signature.Results().Len() != 0 {
+		return false
+	}
+
+	filename := g.program.Fset.Position(fn.Pos()).Filename
+	if !strings.HasSuffix(filename, "_test.go") {
+		return false
+	}
+
+	params := fn.Signature.Params().Len()
+	switch {
+	case hasTestPrefix(fn.Name(), "Test"), hasTestPrefix(fn.Name(), "Benchmark"):
+		return params == 1
+	case hasTestPrefix(fn.Name(), "Example"):
+		return params == 0
+	}
+
+	return false
+}
+
+// hasTestPrefix reports whether name is prefix followed by nothing or a non-lowercase letter,
+// as the go command finds TestXxx functions.
+func hasTestPrefix(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
@@ -0,0 +1,14 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rta
+
+import "go/types"
+
+// unalias returns the type t denotes if t is an alias, or t otherwise.
+// The type switches of this package do not handle *types.Alias,
+// which go/types always creates since Go 1.27; they unalias the types first.
+func unalias(t types.Type) types.Type {
+	return types.Unalias(t)
+}
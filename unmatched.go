@@ -0,0 +1,135 @@
+package gen
+
+import (
+	"bytes"
+	"fmt"
+
+	"go/token"
+	"go/types"
+)
+
+// UnmatchedPolicy specifies how to handle argument types which match none of
+// the templates in a type switch statement.
+type UnmatchedPolicy int
+
+const (
+	// UnmatchedWarn reports unmatched argument types by Gen.Warn and continues.
+	UnmatchedWarn UnmatchedPolicy = iota
+	// UnmatchedFatal makes Expand fail with *UnmatchedTypeError.
+	UnmatchedFatal
+	// UnmatchedIgnore silently ignores unmatched argument types.
+	UnmatchedIgnore
+)
+
+var unmatchedPolicyNames = map[UnmatchedPolicy]string{
+	UnmatchedWarn:   "warn",
+	UnmatchedFatal:  "fatal",
+	UnmatchedIgnore: "ignore",
+}
+
+// String implements flag.Value.
+func (p UnmatchedPolicy) String() string {
+	return unmatchedPolicyNames[p]
+}
+
+// Set implements flag.Value.
+func (p *UnmatchedPolicy) Set(s string) error {
+	for policy, name := range unmatchedPolicyNames {
+		if s == name {
+			*p = policy
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown policy: %q", s)
+}
+
+// UnmatchedTypeError is a diagnostic for an argument type which
+// matches none of the templates in a type switch statement.
+type UnmatchedTypeError struct {
+	// Pos is the position of the type switch statement.
+	Pos token.Position
+
+	// Type is the argument type.
+	Type types.Type
+
+	// Sites is the positions of the call sites the argument type came from.
+	Sites []token.Position
+
+	// Directives is the positions of the //tsgen:instantiate directives
+	// the argument type came from.
+	Directives []token.Position
+
+	// Templates is the templates tried, at the positions of their patterns.
+	Templates []CaseTemplate
+}
+
+// CaseTemplate is a template case clause in a type switch statement.
+type CaseTemplate struct {
+	Pos     token.Position
+	Pattern types.Type
+}
+
+func (e *UnmatchedTypeError) Error() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%s: no template matched for argument type %s", e.Pos, e.Type)
+
+	for _, site := range e.Sites {
+		fmt.Fprintf(&buf, "\n\tfrom call at %s", site)
+	}
+
+	for _, d := range e.Directives {
+		fmt.Fprintf(&buf, "\n\tfrom directive at %s", d)
+	}
+
+	for _, t := range e.Templates {
+		fmt.Fprintf(&buf, "\n\ttried %s at %s", t.Pattern, t.Pos)
+	}
+
+	return buf.String()
+}
+
+// AmbiguousTemplateError is a diagnostic for an argument type which
+// matches more than one templates equally specific in a type switch statement.
+// The first one of them is used to expand the argument type.
+type AmbiguousTemplateError struct {
+	// Pos is the position of the type switch statement.
+	Pos token.Position
+
+	// Type is the argument type.
+	Type types.Type
+
+	// Templates is the matched templates.
+	Templates []CaseTemplate
+}
+
+func (e *AmbiguousTemplateError) Error() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%s: ambiguous templates for argument type %s", e.Pos, e.Type)
+
+	for _, t := range e.Templates {
+		fmt.Fprintf(&buf, "\n\tmatched %s at %s", t.Pattern, t.Pos)
+	}
+
+	return buf.String()
+}
+
+// UnexportedTypeError is a diagnostic for an argument type which refers to
+// an unexported type of another package, so cannot be written in a case clause.
+// No case clause is generated for the argument type.
+type UnexportedTypeError struct {
+	// Pos is the position of the type switch statement.
+	Pos token.Position
+
+	// Type is the argument type.
+	Type types.Type
+
+	// Unexported is the unexported type Type refers to.
+	Unexported *types.TypeName
+}
+
+func (e *UnexportedTypeError) Error() string {
+	return fmt.Sprintf("%s: argument type %s refers to unexported type %s", e.Pos, e.Type, e.Unexported.Type())
+}